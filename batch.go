@@ -0,0 +1,131 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+func newErrBatchCorrupted(reason string) error {
+	return errors.New("aran: batch corrupted: " + reason)
+}
+
+// BatchReplay is fed every record in a Batch, in order, by Batch.Replay.
+// It mirrors the Db write surface so a Batch can be applied either to a
+// live Db or inspected for logging/testing.
+type BatchReplay interface {
+	Put(key, value []byte)
+	Delete(key []byte)
+}
+
+// Batch accumulates Put and Delete records into a single contiguous
+// varint-encoded buffer so they can be written to the memtable and WAL as
+// one atomic unit, modeled on goleveldb's leveldb/batch.go.
+//
+// record layout: op(byte) keylen(varint) key [vallen(varint) value]
+type Batch struct {
+	buf []byte
+	rec int
+}
+
+func (b *Batch) appendRec(op opType, key, value []byte) {
+	n := 1 + binary.MaxVarintLen32 + len(key)
+	if op == opPut {
+		n += binary.MaxVarintLen32 + len(value)
+	}
+	if cap(b.buf)-len(b.buf) < n {
+		grown := make([]byte, len(b.buf), 2*cap(b.buf)+n)
+		copy(grown, b.buf)
+		b.buf = grown
+	}
+	off := len(b.buf)
+	buf := b.buf[:off+n]
+	buf[off] = byte(op)
+	off++
+	off += binary.PutUvarint(buf[off:], uint64(len(key)))
+	off += copy(buf[off:], key)
+	if op == opPut {
+		off += binary.PutUvarint(buf[off:], uint64(len(value)))
+		off += copy(buf[off:], value)
+	}
+	b.buf = buf[:off]
+	b.rec++
+}
+
+// Put appends a put record to the batch.
+func (b *Batch) Put(key, value []byte) {
+	b.appendRec(opPut, key, value)
+}
+
+// Delete appends a point-delete record to the batch.
+func (b *Batch) Delete(key []byte) {
+	b.appendRec(opDelete, key, nil)
+}
+
+// Len reports the number of records accumulated so far.
+func (b *Batch) Len() int {
+	return b.rec
+}
+
+// Reset clears the batch so it can be reused.
+func (b *Batch) Reset() {
+	b.buf = b.buf[:0]
+	b.rec = 0
+}
+
+// size returns the encoded length of the batch, an upper bound on the bytes
+// its records add to the memtable, used to decide whether the memtable must
+// be rotated before the batch is applied.
+func (b *Batch) size() int {
+	return len(b.buf)
+}
+
+// Replay feeds every record in the batch to r, in the order they were
+// added.
+func (b *Batch) Replay(r BatchReplay) error {
+	buf := b.buf
+	for len(buf) > 0 {
+		op := opType(buf[0])
+		buf = buf[1:]
+		klen, n := binary.Uvarint(buf)
+		if n <= 0 {
+			return newErrBatchCorrupted("bad key length")
+		}
+		buf = buf[n:]
+		if uint64(len(buf)) < klen {
+			return newErrBatchCorrupted("truncated key")
+		}
+		key := buf[:klen]
+		buf = buf[klen:]
+		switch op {
+		case opPut:
+			vlen, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return newErrBatchCorrupted("bad value length")
+			}
+			buf = buf[n:]
+			if uint64(len(buf)) < vlen {
+				return newErrBatchCorrupted("truncated value")
+			}
+			value := buf[:vlen]
+			buf = buf[vlen:]
+			r.Put(key, value)
+		case opDelete:
+			r.Delete(key)
+		default:
+			return newErrBatchCorrupted("unknown op")
+		}
+	}
+	return nil
+}
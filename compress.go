@@ -0,0 +1,192 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import (
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"sync"
+
+	"github.com/golang/snappy"
+)
+
+// CompressionType selects how key/value blocks are stored on disk.
+// Zstd support lives behind the zstd build tag; everything else is always
+// available.
+type CompressionType uint8
+
+const (
+	CompressionNone CompressionType = iota
+	CompressionSnappy
+	CompressionZstd
+)
+
+// blockSize is 8 KiB. The table writer does not group records by it:
+// mergeTableBuilder.addRecord writes every record as its own compressed
+// block, whatever its size.
+const blockSize = 8 * 1024
+
+// blockHeader precedes every compressed block on disk so a reader knows
+// how much to read and how to verify/decompress it without consulting
+// anything outside the block itself.
+type blockHeader struct {
+	uncompressedLen uint32
+	compressedLen   uint32
+	algo            CompressionType
+	crc32           uint32
+}
+
+const blockHeaderSize = 4 + 4 + 1 + 4
+
+func (h blockHeader) encode() []byte {
+	buf := make([]byte, blockHeaderSize)
+	binary.BigEndian.PutUint32(buf[0:4], h.uncompressedLen)
+	binary.BigEndian.PutUint32(buf[4:8], h.compressedLen)
+	buf[8] = byte(h.algo)
+	binary.BigEndian.PutUint32(buf[9:13], h.crc32)
+	return buf
+}
+
+func decodeBlockHeader(buf []byte) (blockHeader, error) {
+	if len(buf) < blockHeaderSize {
+		return blockHeader{}, fmt.Errorf("aran: short block header")
+	}
+	return blockHeader{
+		uncompressedLen: binary.BigEndian.Uint32(buf[0:4]),
+		compressedLen:   binary.BigEndian.Uint32(buf[4:8]),
+		algo:            CompressionType(buf[8]),
+		crc32:           binary.BigEndian.Uint32(buf[9:13]),
+	}, nil
+}
+
+// encodeBlock compresses raw with algo and returns a ready-to-write
+// blockHeader+payload, so callers (mergeTableBuilder, hashMap.toDisk) just
+// append the result to the file.
+func encodeBlock(algo CompressionType, raw []byte) []byte {
+	payload := compressBlock(algo, raw)
+	h := blockHeader{
+		uncompressedLen: uint32(len(raw)),
+		compressedLen:   uint32(len(payload)),
+		algo:            algo,
+		crc32:           crc32.Checksum(payload, CastagnoliCrcTable),
+	}
+	out := make([]byte, 0, blockHeaderSize+len(payload))
+	out = append(out, h.encode()...)
+	out = append(out, payload...)
+	return out
+}
+
+// decodeBlock reverses encodeBlock: buf must start at a blockHeader and
+// contain at least header+compressedLen bytes.
+func decodeBlock(buf []byte) ([]byte, error) {
+	h, err := decodeBlockHeader(buf)
+	if err != nil {
+		return nil, err
+	}
+	if blockHeaderSize+int(h.compressedLen) > len(buf) {
+		return nil, fmt.Errorf("aran: block compressedLen %d exceeds buffer", h.compressedLen)
+	}
+	payload := buf[blockHeaderSize : blockHeaderSize+int(h.compressedLen)]
+	if crc32.Checksum(payload, CastagnoliCrcTable) != h.crc32 {
+		return nil, fmt.Errorf("aran: block checksum mismatch")
+	}
+	return decompressBlock(h.algo, payload, int(h.uncompressedLen))
+}
+
+func compressBlock(algo CompressionType, raw []byte) []byte {
+	switch algo {
+	case CompressionSnappy:
+		return snappy.Encode(nil, raw)
+	case CompressionZstd:
+		return zstdCompress(raw)
+	default:
+		return raw
+	}
+}
+
+func decompressBlock(algo CompressionType, compressed []byte, uncompressedLen int) ([]byte, error) {
+	switch algo {
+	case CompressionSnappy:
+		dst := make([]byte, 0, uncompressedLen)
+		return snappy.Decode(dst, compressed)
+	case CompressionZstd:
+		return zstdDecompress(compressed, uncompressedLen)
+	default:
+		return compressed, nil
+	}
+}
+
+// blockCacheKey identifies one decompressed block by the table it came
+// from and its byte offset in that table's file, so hot blocks don't get
+// decompressed again on every lookup.
+type blockCacheKey struct {
+	tableID uint64
+	offset  uint32
+}
+
+// blockCache is a small LRU shared across l0handler and l1handler so a
+// block read through L0 and later through the same table at L1 (or read
+// twice from two concurrent Gets) reuses the same decompressed bytes.
+type blockCache struct {
+	mu       sync.Mutex
+	capacity int
+	size     int
+	ll       *list.List
+	items    map[blockCacheKey]*list.Element
+}
+
+type blockCacheEntry struct {
+	key  blockCacheKey
+	data []byte
+}
+
+func newBlockCache(capacityBytes int) *blockCache {
+	return &blockCache{
+		capacity: capacityBytes,
+		ll:       list.New(),
+		items:    make(map[blockCacheKey]*list.Element),
+	}
+}
+
+func (c *blockCache) get(key blockCacheKey) ([]byte, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.items[key]
+	if !ok {
+		return nil, false
+	}
+	c.ll.MoveToFront(e)
+	return e.Value.(*blockCacheEntry).data, true
+}
+
+func (c *blockCache) put(key blockCacheKey, data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.items[key]; ok {
+		c.ll.MoveToFront(e)
+		e.Value.(*blockCacheEntry).data = data
+		return
+	}
+	e := c.ll.PushFront(&blockCacheEntry{key: key, data: data})
+	c.items[key] = e
+	c.size += len(data)
+	for c.size > c.capacity && c.ll.Len() > 1 {
+		back := c.ll.Back()
+		entry := back.Value.(*blockCacheEntry)
+		c.size -= len(entry.data)
+		c.ll.Remove(back)
+		delete(c.items, entry.key)
+	}
+}
@@ -0,0 +1,29 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build !zstd
+// +build !zstd
+
+package aran
+
+import "fmt"
+
+// zstdCompress/zstdDecompress are stubbed out when built without the zstd
+// tag, so a binary that doesn't need it doesn't pay for the dependency.
+func zstdCompress(raw []byte) []byte {
+	panic("aran: zstd compression requires building with -tags zstd")
+}
+
+func zstdDecompress(compressed []byte, uncompressedLen int) ([]byte, error) {
+	return nil, fmt.Errorf("aran: zstd compression requires building with -tags zstd")
+}
@@ -0,0 +1,46 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import (
+	"bytes"
+	"testing"
+)
+
+// TestEncodeDecodeBlockRoundTrips confirms decodeBlock recovers exactly what
+// encodeBlock was given, for every always-available CompressionType.
+func TestEncodeDecodeBlockRoundTrips(t *testing.T) {
+	raw := bytes.Repeat([]byte("the quick brown fox jumps over the lazy dog"), 200)
+
+	for _, algo := range []CompressionType{CompressionNone, CompressionSnappy} {
+		buf := encodeBlock(algo, raw)
+		got, err := decodeBlock(buf)
+		if err != nil {
+			t.Fatalf("algo %d: decodeBlock: %v", algo, err)
+		}
+		if !bytes.Equal(got, raw) {
+			t.Fatalf("algo %d: decodeBlock round-trip mismatch", algo)
+		}
+	}
+}
+
+// TestDecodeBlockRejectsCorruptChecksum confirms a flipped payload byte is
+// caught by the block's own CRC rather than silently decompressed.
+func TestDecodeBlockRejectsCorruptChecksum(t *testing.T) {
+	buf := encodeBlock(CompressionSnappy, []byte("some data worth compressing, worth compressing"))
+	buf[len(buf)-1] ^= 0xff
+
+	if _, err := decodeBlock(buf); err == nil {
+		t.Fatalf("decodeBlock should reject a corrupted payload")
+	}
+}
@@ -0,0 +1,33 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+//go:build zstd
+// +build zstd
+
+package aran
+
+import "github.com/klauspost/compress/zstd"
+
+var (
+	zstdEncoder, _ = zstd.NewWriter(nil)
+	zstdDecoder, _ = zstd.NewReader(nil)
+)
+
+func zstdCompress(raw []byte) []byte {
+	return zstdEncoder.EncodeAll(raw, nil)
+}
+
+func zstdDecompress(compressed []byte, uncompressedLen int) ([]byte, error) {
+	dst := make([]byte, 0, uncompressedLen)
+	return zstdDecoder.DecodeAll(compressed, dst)
+}
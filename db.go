@@ -13,11 +13,11 @@
 package aran
 
 import (
-	"fmt"
 	"hash/crc32"
 	"os"
 	"path/filepath"
 	"sync"
+	"sync/atomic"
 
 	"github.com/Sirupsen/logrus"
 	"github.com/dgraph-io/badger/y"
@@ -32,18 +32,58 @@ type Db struct {
 	manifest            *manifest
 	mtable              *hashMap
 	immtable            *hashMap
-	flushDisk           chan *hashMap
+	log                 *logFile
+	flushDisk           chan *flushJob
 	writeCloser         *y.Closer
 	loadBalancingCloser *y.Closer
 	compactionCloser    *y.Closer
 	flushDiskCloser     *y.Closer
+	seqCounter          uint64
+	pendingRemoval      []*table
+	blockCache          *blockCache
 	sync.RWMutex
 }
 
+// defaultBlockCacheSize bounds how much decompressed block data New keeps
+// around; it's shared by l0handler and l1handler so a block read at one
+// level doesn't get decompressed twice just because it's also read at the
+// other.
+const defaultBlockCacheSize = 32 * 1024 * 1024
+
+// flushJob pairs an immutable memtable with the WAL it was recorded in, so
+// flushMem can delete that log only once the memtable has safely landed as
+// an L0 table and the manifest records the table in its place.
+type flushJob struct {
+	mtable *hashMap
+	log    *logFile
+}
+
+// opType tags a request with the mutation it carries through the
+// writeChan/write pipeline so the memtable can record puts and tombstones
+// side by side in the same hashMap.
+type opType uint8
+
+const (
+	opPut opType = iota
+	opDelete
+	opRangeDelete
+	opBatch
+)
+
 type request struct {
+	op    opType
 	key   []byte
 	value []byte
-	wg    sync.WaitGroup
+	start []byte
+	end   []byte
+	batch *Batch
+	seq   uint64
+	// log is the WAL req's mutation was actually appended to. A group can
+	// span a memtable rotation, so requests drained together don't
+	// necessarily share one log; writeGroup fsyncs every log its group
+	// touched, not just the one current when the group finished.
+	log *logFile
+	wg  sync.WaitGroup
 }
 
 func New(opts Options) (*Db, error) {
@@ -56,12 +96,13 @@ func New(opts Options) (*Db, error) {
 		return nil, err
 	}
 
-	l0handler := newLevelHanlder()
+	cache := newBlockCache(defaultBlockCacheSize)
+	l0handler := newLevelHanlder(cache)
 	for _, l0file := range manifest.L0Files {
 		t := newTable(absPath, l0file.Idx)
 		l0handler.addTable(t, l0file.Idx)
 	}
-	l1handler := newLevelHanlder()
+	l1handler := newLevelHanlder(cache)
 	for _, l1file := range manifest.L1Files {
 		t := newTable(absPath, l1file.Idx)
 		l1handler.addTable(t, l1file.Idx)
@@ -71,15 +112,30 @@ func New(opts Options) (*Db, error) {
 		writeChan:           make(chan *request, 1000),
 		absPath:             absPath,
 		manifest:            manifest,
-		mtable:              newHashMap(opts.memtablesize),
 		l0handler:           l0handler,
 		l1handler:           l1handler,
 		writeCloser:         y.NewCloser(1),
 		loadBalancingCloser: y.NewCloser(1),
 		compactionCloser:    y.NewCloser(1),
 		flushDiskCloser:     y.NewCloser(1),
-		flushDisk:           make(chan *hashMap, 1),
+		flushDisk:           make(chan *flushJob, 1),
+		blockCache:          cache,
+	}
+	if err := db.recoverFromLogs(); err != nil {
+		return nil, err
+	}
+	if db.manifest.LastSeq > db.seqCounter {
+		db.seqCounter = db.manifest.LastSeq
 	}
+	nxtLogID := db.manifest.nextFileID()
+	log, err := createLog(absPath, nxtLogID)
+	if err != nil {
+		return nil, err
+	}
+	db.manifest.setLogID(nxtLogID)
+	db.mtable = newHashMap(opts.memtablesize)
+	db.log = log
+
 	go db.runCompaction(db.compactionCloser)
 	go db.listenForFlushing(db.flushDiskCloser)
 	go db.loadBalancing(db.loadBalancingCloser)
@@ -87,15 +143,52 @@ func New(opts Options) (*Db, error) {
 	return db, nil
 }
 
+// recoverFromLogs replays any log files left behind by a crash into a
+// throwaway memtable and flushes it to an L0 table before New lets any
+// traffic through, so a crash between a Set returning and the next flush
+// never silently loses data.
+func (d *Db) recoverFromLogs() error {
+	orphans, err := scanOrphanLogs(d.absPath)
+	if err != nil {
+		return err
+	}
+	if len(orphans) == 0 {
+		return nil
+	}
+	recovered := newHashMap(d.opts.memtablesize)
+	for _, id := range orphans {
+		maxSeq, err := replayLog(d.absPath, id, recovered)
+		if err != nil {
+			return err
+		}
+		if maxSeq > d.seqCounter {
+			d.seqCounter = maxSeq
+		}
+	}
+	if recovered.Len() > 0 {
+		d.flushMem(recovered)
+		if err := d.manifest.save(d.absPath); err != nil {
+			return err
+		}
+	}
+	for _, id := range orphans {
+		if err := os.Remove(giveLogPath(d.absPath, id)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
 func (d *Db) Close() {
 
 	d.loadBalancingCloser.SignalAndWait()
 	d.compactionCloser.SignalAndWait()
 	d.writeCloser.SignalAndWait()
 	if d.mtable.Len() > 0 {
-		d.flushDisk <- d.mtable
+		d.flushDisk <- &flushJob{mtable: d.mtable, log: d.log}
 	}
 	d.flushDiskCloser.SignalAndWait()
+	d.manifest.setLastSeq(atomic.LoadUint64(&d.seqCounter))
 	err := d.manifest.save(d.absPath)
 	if err != nil {
 		logrus.Fatalf("manifest: unable to save the manifest %s", err.Error())
@@ -104,6 +197,7 @@ func (d *Db) Close() {
 
 func (d *Db) Set(key, val []byte) {
 	r := request{
+		op:    opPut,
 		key:   key,
 		value: val,
 	}
@@ -111,15 +205,52 @@ func (d *Db) Set(key, val []byte) {
 	d.writeChan <- &r
 	r.wg.Wait()
 }
+
+// Delete removes key by recording a tombstone in the memtable. The key
+// keeps occupying space until mergeTable drops it once no older table can
+// still shadow it.
+func (d *Db) Delete(key []byte) {
+	r := request{
+		op:  opDelete,
+		key: key,
+	}
+	r.wg.Add(1)
+	d.writeChan <- &r
+	r.wg.Wait()
+}
+
+// DeleteRange removes every key in [start, end) by recording a range
+// tombstone instead of one tombstone per key.
+func (d *Db) DeleteRange(start, end []byte) {
+	r := request{
+		op:    opRangeDelete,
+		start: start,
+		end:   end,
+	}
+	r.wg.Add(1)
+	d.writeChan <- &r
+	r.wg.Wait()
+}
+
+// Write submits b as a single atomic request through writeChan: every
+// record in the batch lands in the memtable, or none of them do.
+func (d *Db) Write(b *Batch) {
+	r := request{
+		op:    opBatch,
+		batch: b,
+	}
+	r.wg.Add(1)
+	d.writeChan <- &r
+	r.wg.Wait()
+}
+
 func (d *Db) acceptWrite(closer *y.Closer) {
 
 loop:
 	for {
 		select {
 		case req := <-d.writeChan:
-
-			// do write
-			d.write(req)
+			d.writeGroup(d.drainWriteChan(req))
 
 		case <-closer.HasBeenClosed():
 			break loop
@@ -127,23 +258,163 @@ loop:
 	}
 	close(d.writeChan)
 	for req := range d.writeChan {
-		d.write(req)
+		d.writeGroup([]*request{req})
 	}
 	closer.Done()
 }
 
+// drainWriteChan collects every request already queued behind first
+// without blocking, so their fsyncs can be grouped into one.
+func (d *Db) drainWriteChan(first *request) []*request {
+	reqs := []*request{first}
+	for {
+		select {
+		case r := <-d.writeChan:
+			reqs = append(reqs, r)
+		default:
+			return reqs
+		}
+	}
+}
+
+// writeGroup applies every request to the memtable and WAL, then fsyncs
+// every log the group actually wrote to before unblocking any of the
+// waiting callers, amortizing the fsync cost across however many writes
+// queued up. A group can span a mid-group rotateMemtable, so requests
+// drained together don't necessarily share one log; syncing only d.log
+// (the log current once the group finished) would let an fsync silently
+// skip the older log a leading request in the same group was appended to.
+func (d *Db) writeGroup(reqs []*request) {
+	for _, req := range reqs {
+		d.write(req)
+	}
+	if d.opts.SyncWrites {
+		synced := make(map[uint64]bool, 1)
+		for _, req := range reqs {
+			if synced[req.log.id] {
+				continue
+			}
+			synced[req.log.id] = true
+			if err := req.log.sync(); err != nil {
+				logrus.Fatalf("wal: unable to fsync log %d: %s", req.log.id, err.Error())
+			}
+		}
+	}
+	for _, req := range reqs {
+		req.wg.Done()
+	}
+}
+
 func (d *Db) write(req *request) {
 
-	if !d.mtable.isEnoughSpace(len(req.key) + len(req.value)) {
-		d.Lock()
-		d.immtable = d.mtable
-		d.mtable = newHashMap(d.opts.memtablesize)
-		d.Unlock()
-		d.flushDisk <- d.immtable
+	size := len(req.key) + len(req.value)
+	if req.op == opBatch {
+		size = req.batch.size()
+	}
+	if !d.mtable.isEnoughSpace(size) {
+		d.rotateMemtable()
+	}
+	// every request gets the next sequence number here, on the single
+	// goroutine that serializes all writes, so seq order always matches
+	// WAL and memtable application order; snapshots filter reads against
+	// this number.
+	req.seq = atomic.AddUint64(&d.seqCounter, 1)
+	req.log = d.log
+	d.appendToLog(req)
+	switch req.op {
+	case opPut:
+		d.mtable.Set(req.key, req.value, req.seq)
+	case opDelete:
+		d.mtable.SetTombstone(req.key, req.seq)
+	case opRangeDelete:
+		d.mtable.SetRangeTombstone(req.start, req.end, req.seq)
+	case opBatch:
+		// the memtable was rotated above if the batch did not fit, so the
+		// whole batch lands in this one memtable; applying it record by record
+		// here is still atomic from any reader's point of view: nothing
+		// else can observe d.mtable mid-batch since writes are serialized
+		// through this single goroutine.
+		req.batch.Replay(memtableReplay{mtable: d.mtable, seq: req.seq})
+	}
+}
+
+// rotateMemtable rolls mtable to immtable and hands it to the flusher
+// together with the WAL it was recorded in, and opens a fresh log tied to
+// the new memtable. The old log is only deleted once flushMem has the
+// replacement L0 table and manifest entry safely in place.
+func (d *Db) rotateMemtable() {
+	nxtLogID := d.manifest.nextFileID()
+	newLog, err := createLog(d.absPath, nxtLogID)
+	if err != nil {
+		logrus.Fatalf("wal: unable to create log %d: %s", nxtLogID, err.Error())
+	}
+	d.Lock()
+	oldLog := d.log
+	d.immtable = d.mtable
+	d.mtable = newHashMap(d.opts.memtablesize)
+	d.log = newLog
+	d.Unlock()
+	d.manifest.setLogID(nxtLogID)
+	d.flushDisk <- &flushJob{mtable: d.immtable, log: oldLog}
+}
+
+// appendToLog writes req's mutation to the current WAL. Sync is the
+// caller's responsibility (see writeGroup) so fsyncs can be batched.
+func (d *Db) appendToLog(req *request) {
+	var err error
+	switch req.op {
+	case opPut:
+		err = d.log.append(opPut, req.seq, req.key, req.value)
+	case opDelete:
+		err = d.log.append(opDelete, req.seq, req.key, nil)
+	case opRangeDelete:
+		err = d.log.append(opRangeDelete, req.seq, req.start, req.end)
+	case opBatch:
+		r := &logReplay{log: d.log, seq: req.seq}
+		req.batch.Replay(r)
+		err = r.err
+	}
+	if err != nil {
+		logrus.Fatalf("wal: unable to append to log %d: %s", d.log.id, err.Error())
+	}
+}
+
+// logReplay adapts logFile to BatchReplay so a Batch can be appended to
+// the WAL record by record, same as it's applied to the memtable. Every
+// record in the batch shares one sequence number, matching how it's
+// applied to the memtable as a single atomic unit.
+type logReplay struct {
+	log *logFile
+	seq uint64
+	err error
+}
+
+func (l *logReplay) Put(key, value []byte) {
+	if l.err == nil {
+		l.err = l.log.append(opPut, l.seq, key, value)
+	}
+}
+
+func (l *logReplay) Delete(key []byte) {
+	if l.err == nil {
+		l.err = l.log.append(opDelete, l.seq, key, nil)
 	}
-	d.mtable.Set(req.key, req.value)
-	req.wg.Done()
+}
+
+// memtableReplay adapts hashMap to BatchReplay so a Batch can be applied
+// directly to the active memtable, stamping every record with the
+// batch's shared sequence number.
+type memtableReplay struct {
+	mtable *hashMap
+	seq    uint64
+}
+
+func (m memtableReplay) Put(key, value []byte) {
+	m.mtable.Set(key, value, m.seq)
+}
 
+func (m memtableReplay) Delete(key []byte) {
+	m.mtable.SetTombstone(key, m.seq)
 }
 
 func (d *Db) listenForFlushing(closer *y.Closer) {
@@ -155,42 +426,76 @@ loop:
 		select {
 		case <-closer.HasBeenClosed():
 			break loop
-		case imtable := <-d.flushDisk:
-			d.flushMem(imtable)
+		case job := <-d.flushDisk:
+			d.runFlushJob(job)
 		}
 	}
 	close(d.flushDisk)
-	for imtable := range d.flushDisk {
-		d.flushMem(imtable)
+	for job := range d.flushDisk {
+		d.runFlushJob(job)
 	}
 	closer.Done()
 }
 
+// runFlushJob flushes job's memtable to an L0 table and, only once that
+// table and its manifest entry are durable, deletes the WAL that recorded
+// the memtable's writes.
+func (d *Db) runFlushJob(job *flushJob) {
+	d.flushMem(job.mtable)
+	if job.log == nil {
+		return
+	}
+	if err := job.log.remove(d.absPath); err != nil && !os.IsNotExist(err) {
+		logrus.Fatalf("wal: unable to remove log %d: %s", job.log.id, err.Error())
+	}
+}
+
 func (d *Db) flushMem(imtable *hashMap) {
 	nxtID := d.manifest.nextFileID()
-	imtable.toDisk(d.absPath, nxtID)
+	imtable.toDisk(d.absPath, nxtID, d.opts.Compression)
 	d.manifest.addl0file(imtable.records, imtable.minRange, imtable.maxRange, imtable.occupiedSpace(), nxtID)
 	table := newTable(d.absPath, nxtID)
+	table.rangeTombstones = imtable.rangeTombstones
 	d.l0handler.addTable(table, nxtID)
 	d.Lock()
 	d.immtable = nil
 	d.Unlock()
 }
 
-func (d *Db) mergeTable(t1, t2 *table) {
+// mergeTable compacts t1 and t2 (t1 newer than t2) into a new L1 table. Puts
+// and tombstones from t1 shadow same-key entries from t2; range tombstones
+// from both tables are merged and dropped only when isBottom reports there
+// is no older overlapping table left to shadow. Called with
+// d.manifest.mutex already held by L0Compaction.
+func (d *Db) mergeTable(t1, t2 *table, isBottom bool) {
 	t1.SeekBegin()
 	t2.SeekBegin()
-	builder := newTableMergeBuilder(int(t1.size + t2.size))
+	builder := newTableMergeBuilder(int(t1.size+t2.size), d.opts.Compression)
 	builder.append(t1.fp, int64(t1.fileInfo.metaOffset))
 	builder.append(t2.fp, int64(t2.fileInfo.metaOffset))
 	builder.mergeHashMap(t1.offsetMap, 0)
 	builder.mergeHashMap(t2.offsetMap, uint32(t1.fileInfo.metaOffset))
+	builder.dropTombstones(isBottom)
+	rangeTombstones := mergeRangeTombstoneLists(t1.rangeTombstones, t2.rangeTombstones)
+	if !isBottom {
+		builder.setRangeTombstones(rangeTombstones)
+	} else {
+		// the range tombstones are not written out, so the point entries
+		// they shadow are dropped here instead.
+		for k, loc := range builder.idx.Offsets {
+			if seq, covered := rangeTombstones.covers([]byte(k), ^uint64(0)); covered && seq > loc.Seq {
+				delete(builder.idx.Offsets, k)
+				builder.entries--
+			}
+		}
+	}
 	buf := builder.finish()
 	d.saveL1Table(buf)
 }
 
+// saveL1Table is called with d.manifest.mutex already held by L0Compaction.
 func (d *Db) saveL1Table(buf []byte) {
-	FID := d.manifest.nextFileID()
+	FID := d.manifest.nextFileIDLocked()
 	fp, err := os.Create(giveTablePath(d.absPath, FID))
 	if err != nil {
 		logrus.Fatalf("compaction: unable to create new while pushing to level 1 %s", err.Error())
@@ -207,27 +512,40 @@ func (d *Db) saveL1Table(buf []byte) {
 	newt := newTable(d.absPath, FID)
 	d.l1handler.addTable(newt, FID)
 
-	d.manifest.addl1file(uint32(newt.fileInfo.entries), newt.fileInfo.minRange, newt.fileInfo.maxRange, int(newt.size), FID)
+	d.manifest.addl1fileLocked(uint32(newt.fileInfo.entries), newt.fileInfo.minRange, newt.fileInfo.maxRange, int(newt.size), FID)
 	logrus.Infof("comapction: new l1 file has beed added %d", FID)
 }
 
+// L0Compaction picks the two smallest L0 tables and merges them into L1.
+// The whole isBottom-decide -> merge -> save sequence runs under
+// d.manifest.mutex, the same lock Ingest holds across its own L1 inserts:
+// without it, a concurrent Ingest could land a table between the isBottom
+// read and the merge actually landing, resurrecting data a tombstone in the
+// table being compacted away was supposed to still shadow.
 func (d *Db) L0Compaction() {
+	d.manifest.mutex.Lock()
+	defer d.manifest.mutex.Unlock()
+
 	// sorting according to the denisty
-	d.manifest.sortL0()
+	d.manifest.sortL0Locked()
 	// create two victim table
-	d.manifest.mutex.Lock()
 	t1, t2 := newTable(d.absPath, d.manifest.L0Files[0].Idx), newTable(d.absPath, d.manifest.L0Files[1].Idx)
-	d.manifest.mutex.Unlock()
-	d.mergeTable(t1, t2)
+	// mergeTable lets t1's entries win over t2's, so t1 must be the newer
+	// (higher id) of the two.
+	if t2.ID() > t1.ID() {
+		t1, t2 = t2, t1
+	}
+	// merging straight into L1 makes this the bottom level only when no L1
+	// files exist yet; otherwise an older overlapping L1 table may still
+	// need the tombstones we're about to write.
+	d.mergeTable(t1, t2, d.manifest.l1LenLocked() == 0)
 	d.l0handler.deleteTable(t1.ID())
-	t1.close()
-	removeTable(d.absPath, t1.ID())
-	d.manifest.deleteL0Table(t1.ID())
+	d.retireTable(t1)
+	d.manifest.deleteL0TableLocked(t1.ID())
 	logrus.Infof("comapction: l0 file has beed deleted %d", t1.ID())
 	d.l0handler.deleteTable(t2.ID())
-	t2.close()
-	removeTable(d.absPath, t2.ID())
-	d.manifest.deleteL0Table(t2.ID())
+	d.retireTable(t2)
+	d.manifest.deleteL0TableLocked(t2.ID())
 	logrus.Infof("comapction: l0 file has beed deleted %d", t2.ID())
 }
 
@@ -241,31 +559,12 @@ loop:
 		case <-closer.HasBeenClosed():
 			break loop
 		default:
-			// check for l0Tables
-			len := d.manifest.l0Len()
-			if len >= d.opts.NoOfL0Files {
-				if d.manifest.l1Len() == 0 {
-					d.L0Compaction()
-				}
-				// level one files already exist so find union set to push
-				// if overlapping range then append accordingly other wise just push down
-				l0fs := d.manifest.copyL0()
-				fmt.Printf("%+v \n", d.manifest)
-				for _, l0f := range l0fs {
-					p := d.manifest.findL1Policy(l0f)
-					if p.policy == NOTUNION {
-						d.handleNotUnion(p, l0f)
-						continue
-					}
-					if p.policy == UNION {
-						d.handleUnion(p, l0f)
-						continue
-					}
-
-					if p.policy == OVERLAPPING {
-						d.handleOverlapping(p, l0f)
-					}
-				}
+			// L0Compaction always merges the two smallest L0 tables into a
+			// new L1 table (regardless of whether L1 already has files), so
+			// keeping L0 under NoOfL0Files is just a matter of calling it
+			// while there's enough pressure and at least a pair to merge.
+			if d.manifest.l0Len() >= d.opts.NoOfL0Files && d.manifest.l0Len() >= 2 {
+				d.L0Compaction()
 			}
 		}
 	}
@@ -289,7 +588,12 @@ loop:
 					ents := l1t.entries()
 					k := len(ents) / 2
 					median := ents[k]
-					builders := []*mergeTableBuilder{newTableMergeBuilder(int(l1f.Size) / 2), newTableMergeBuilder(int(l1f.Size) / 2)}
+					builders := []*mergeTableBuilder{
+						newTableMergeBuilder(int(l1f.Size)/2, d.opts.Compression),
+						newTableMergeBuilder(int(l1f.Size)/2, d.opts.Compression),
+					}
+					// saveL1Table uses the manifest's Locked helpers.
+					d.manifest.mutex.Lock()
 					iter := l1t.iter()
 					for iter.has() {
 						kl, vl, key, val := iter.next()
@@ -306,6 +610,8 @@ loop:
 					d.saveL1Table(builders[0].finish())
 					d.saveL1Table(builders[1].finish())
 					d.l1handler.deleteTable(l1f.Idx)
+					d.manifest.mutex.Unlock()
+					d.retireTable(l1t)
 					d.manifest.deleteL1Table(l1f.Idx)
 					logrus.Infof("load balancing: l1 file %d is splitted into two l1 files properly", l1f.Idx)
 				}
@@ -316,20 +622,25 @@ loop:
 }
 
 func (d *Db) Get(key []byte) ([]byte, bool) {
-	val, exist := d.mtable.Get(key)
+	val, op, exist := d.mtable.Get(key)
 	if exist {
-		return val, exist
+		return val, op == opPut
 	}
 	if d.immtable != nil {
-		val, exist := d.immtable.Get(key)
+		val, op, exist := d.immtable.Get(key)
 		if exist {
-			return val, exist
+			return val, op == opPut
 		}
 	}
 
-	val, exist = d.l0handler.get(key)
-	if exist {
-		return val, exist
+	// get on a level handler stops at the newest table that has anything to
+	// say about key; a tombstone hit counts as "found" here and is
+	// reported back as not-found to the caller without consulting the
+	// next, older level.
+	val, deleted, exist := d.l0handler.get(key)
+	if exist || deleted {
+		return val, exist && !deleted
 	}
-	return d.l1handler.get(key)
+	val, deleted, exist = d.l1handler.get(key)
+	return val, exist && !deleted
 }
@@ -0,0 +1,61 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import "testing"
+
+// TestBatchAppliesAtomicallyAcrossRotation forces a Batch to land right on
+// a memtable rotation: the memtable only has room for the seed write, so
+// write() must rotate before applying the batch. The whole batch should
+// still show up as a single atomic unit in the post-rotation memtable
+// instead of being split across the old and new one.
+func TestBatchAppliesAtomicallyAcrossRotation(t *testing.T) {
+	dir := t.TempDir()
+	db, err := New(Options{
+		Path: dir,
+		// big enough for the seed write, too small to also fit the batch
+		// below, so write() has to rotate before applying it.
+		memtablesize: 10,
+		NoOfL0Files:  1 << 30,
+		maxL1Size:    1 << 30,
+	})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+
+	db.Set([]byte("seed"), []byte("x"))
+
+	b := &Batch{}
+	b.Put([]byte("k1"), []byte("v1"))
+	b.Put([]byte("k2"), []byte("v2"))
+	b.Put([]byte("k3"), []byte("v3"))
+	db.Write(b)
+
+	want := map[string]string{"k1": "v1", "k2": "v2", "k3": "v3"}
+	for key, value := range want {
+		val, ok := db.Get([]byte(key))
+		if !ok || string(val) != value {
+			t.Fatalf("Get(%q) = %q, %v; want %q, true", key, val, ok, value)
+		}
+	}
+	if val, ok := db.Get([]byte("seed")); !ok || string(val) != "x" {
+		t.Fatalf("Get(seed) = %q, %v; want x, true", val, ok)
+	}
+
+	// the batch landed entirely in the memtable that replaced the rotated
+	// one, not split across the rotation.
+	if n := db.mtable.Len(); n != len(want) {
+		t.Fatalf("mtable has %d records, want %d (the whole batch, nothing else)", n, len(want))
+	}
+}
@@ -0,0 +1,236 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import (
+	"bytes"
+	"os"
+	"sort"
+	"sync"
+)
+
+// hashMapEntry is one put or point-tombstone record held by a hashMap,
+// tagged with the seq it was written at so GetAsOf/sortedEntriesAsOf can
+// filter against a Snapshot.
+type hashMapEntry struct {
+	value []byte
+	op    opType
+	seq   uint64
+}
+
+// hashMap is the in-memory table backing Db.mtable/Db.immtable: a plain map
+// plus the bookkeeping (key range, range tombstones, occupied space) that
+// toDisk needs to write it out as an L0 table.
+type hashMap struct {
+	mu       sync.RWMutex
+	capacity int
+	size     int
+	m        map[string]hashMapEntry
+
+	minRange []byte
+	maxRange []byte
+	records  uint32
+
+	rangeTombstones *rangeTombstoneList
+}
+
+func newHashMap(capacity int) *hashMap {
+	return &hashMap{
+		capacity:        capacity,
+		m:               make(map[string]hashMapEntry),
+		rangeTombstones: newRangeTombstoneList(),
+	}
+}
+
+// isEnoughSpace reports whether n more bytes fit before the memtable needs
+// to be rotated.
+func (h *hashMap) isEnoughSpace(n int) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.size+n <= h.capacity
+}
+
+// updateRange grows minRange/maxRange to include key. Caller holds h.mu.
+func (h *hashMap) updateRange(key []byte) {
+	if h.minRange == nil || bytes.Compare(key, h.minRange) < 0 {
+		h.minRange = append([]byte(nil), key...)
+	}
+	if h.maxRange == nil || bytes.Compare(key, h.maxRange) > 0 {
+		h.maxRange = append([]byte(nil), key...)
+	}
+}
+
+func (h *hashMap) Set(key, value []byte, seq uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.m[string(key)]; !ok {
+		h.records++
+	}
+	h.size += len(key) + len(value)
+	h.m[string(key)] = hashMapEntry{value: value, op: opPut, seq: seq}
+	h.updateRange(key)
+}
+
+// SetTombstone records key as deleted as of seq. The entry still occupies a
+// slot in the map (and on disk once flushed) until compaction drops it.
+func (h *hashMap) SetTombstone(key []byte, seq uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if _, ok := h.m[string(key)]; !ok {
+		h.records++
+	}
+	h.size += len(key)
+	h.m[string(key)] = hashMapEntry{op: opDelete, seq: seq}
+	h.updateRange(key)
+}
+
+func (h *hashMap) SetRangeTombstone(start, end []byte, seq uint64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.rangeTombstones.add(start, end, seq)
+	h.updateRange(start)
+	h.updateRange(end)
+}
+
+// Get returns the live state of key: a put's value, a point tombstone
+// (exist=true, op=opDelete, value=nil), or not-found at all. When both a
+// point entry and a covering range tombstone exist for key, whichever has
+// the higher seq wins (the point entry on a tie): a range tombstone shadows
+// a point entry written before it, but not one written after it.
+func (h *hashMap) Get(key []byte) ([]byte, opType, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.getLocked(key, ^uint64(0))
+}
+
+// GetAsOf is Get filtered to state recorded at or before asOf, so a
+// Snapshot reading a still-live memtable doesn't see writes made after it
+// was taken.
+func (h *hashMap) GetAsOf(key []byte, asOf uint64) ([]byte, opType, bool) {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.getLocked(key, asOf)
+}
+
+// getLocked is the shared Get/GetAsOf lookup. Caller holds h.mu.
+func (h *hashMap) getLocked(key []byte, asOf uint64) ([]byte, opType, bool) {
+	e, hasPoint := h.m[string(key)]
+	if hasPoint && e.seq > asOf {
+		hasPoint = false
+	}
+	tombSeq, covered := h.rangeTombstones.covers(key, asOf)
+	if hasPoint && (!covered || e.seq >= tombSeq) {
+		return e.value, e.op, true
+	}
+	if covered {
+		return nil, opDelete, true
+	}
+	return nil, 0, false
+}
+
+func (h *hashMap) Len() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.m)
+}
+
+// occupiedSpace is the byte size toDisk's caller records in the manifest
+// for this table.
+func (h *hashMap) occupiedSpace() int {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return h.size
+}
+
+// sortedEntries returns every record, point tombstones included, in key
+// order, for the merge iterator to scan over.
+func (h *hashMap) sortedEntries() []iterEntry {
+	return h.sortedEntriesAsOf(^uint64(0))
+}
+
+// sortedEntriesAsOf is sortedEntries filtered to asOf, backing a Snapshot's
+// iterator over a still-mutable memtable. Same as getLocked, a point entry
+// shadowed by a higher-seq covering range tombstone is surfaced as a
+// tombstone instead of its stale value, so callers (the merge iterator,
+// toDisk) never need to separately re-check this hashMap's own range
+// tombstones against its own point entries.
+func (h *hashMap) sortedEntriesAsOf(asOf uint64) []iterEntry {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	entries := make([]iterEntry, 0, len(h.m))
+	for k, e := range h.m {
+		if e.seq > asOf {
+			continue
+		}
+		op, value := e.op, e.value
+		if tombSeq, covered := h.rangeTombstones.covers([]byte(k), asOf); covered && tombSeq > e.seq {
+			op, value = opDelete, nil
+		}
+		entries = append(entries, iterEntry{key: []byte(k), value: value, op: op})
+	}
+	sort.Slice(entries, func(i, j int) bool { return bytes.Compare(entries[i].key, entries[j].key) < 0 })
+	return entries
+}
+
+// toDisk writes every record to a new table file at absPath/id, in key
+// order, compressed per the given algo. It's the only place a hashMap's
+// contents become an on-disk table.
+func (h *hashMap) toDisk(absPath string, id uint64, compression CompressionType) error {
+	h.mu.RLock()
+	entries := make([]hashMapEntry, 0, len(h.m))
+	keys := make([]string, 0, len(h.m))
+	for k, e := range h.m {
+		keys = append(keys, k)
+		entries = append(entries, e)
+	}
+	ranges := append([]rangeTombstone(nil), h.rangeTombstones.tombstones...)
+	h.mu.RUnlock()
+
+	sort.Sort(byKeyEntries{keys: keys, entries: entries})
+
+	b := newTableMergeBuilder(h.size, compression)
+	for i, k := range keys {
+		e := entries[i]
+		b.addRecord(e.op, []byte(k), e.value, e.seq)
+	}
+	if !h.rangeTombstones.isEmpty() {
+		rt := newRangeTombstoneList()
+		rt.tombstones = ranges
+		b.setRangeTombstones(rt)
+	}
+	buf := b.finish()
+
+	fp, err := os.Create(giveTablePath(absPath, id))
+	if err != nil {
+		return err
+	}
+	defer fp.Close()
+	if _, err := fp.Write(buf); err != nil {
+		return err
+	}
+	return nil
+}
+
+// byKeyEntries sorts a hashMap's snapshot of keys/entries together in key
+// order, since toDisk must write records in ascending key order.
+type byKeyEntries struct {
+	keys    []string
+	entries []hashMapEntry
+}
+
+func (b byKeyEntries) Len() int { return len(b.keys) }
+func (b byKeyEntries) Less(i, j int) bool { return b.keys[i] < b.keys[j] }
+func (b byKeyEntries) Swap(i, j int) {
+	b.keys[i], b.keys[j] = b.keys[j], b.keys[i]
+	b.entries[i], b.entries[j] = b.entries[j], b.entries[i]
+}
@@ -0,0 +1,172 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/Sirupsen/logrus"
+)
+
+// KeyRange is the inclusive [Start, End] range a table's keys fall within,
+// the same shape manifest already tracks per L0/L1 file.
+type KeyRange struct {
+	Start []byte
+	End   []byte
+}
+
+func (r KeyRange) overlaps(o KeyRange) bool {
+	return bytes.Compare(r.Start, o.End) <= 0 && bytes.Compare(o.Start, r.End) <= 0
+}
+
+type ingestFile struct {
+	path     string
+	table    *table
+	keyRange KeyRange
+}
+
+// Ingest links externally-built SSTables into the LSM tree, the way
+// Pebble's ingest.go does: it lets callers bulk-load data produced offline
+// (e.g. by a MapReduce job) in constant time instead of round-tripping
+// every key through Set. The files are linked in one at a time: a reader
+// can see the earlier files of a call before the later ones, and if one
+// file fails to link, the files linked before it stay in the store.
+func (d *Db) Ingest(paths []string) error {
+	if len(paths) == 0 {
+		return nil
+	}
+
+	files := make([]*ingestFile, 0, len(paths))
+	for _, p := range paths {
+		t, err := openTableForIngest(p)
+		if err != nil {
+			return fmt.Errorf("aran: ingest: %s: %w", p, err)
+		}
+		files = append(files, &ingestFile{
+			path:     p,
+			table:    t,
+			keyRange: KeyRange{Start: t.fileInfo.minRange, End: t.fileInfo.maxRange},
+		})
+	}
+	for i := 0; i < len(files); i++ {
+		for j := i + 1; j < len(files); j++ {
+			if files[i].keyRange.overlaps(files[j].keyRange) {
+				closeIngestFiles(files)
+				return fmt.Errorf("aran: ingest: %s and %s have overlapping key ranges", files[i].path, files[j].path)
+			}
+		}
+	}
+
+	// compaction and loadBalancing both read/write the manifest under this
+	// same lock, so holding it here guarantees they never see a table
+	// that's been linked in but not yet recorded.
+	d.manifest.mutex.Lock()
+	defer d.manifest.mutex.Unlock()
+
+	for i, f := range files {
+		if err := d.ingestOne(f); err != nil {
+			closeIngestFiles(files[i:])
+			return err
+		}
+	}
+	return nil
+}
+
+// closeIngestFiles closes every file's still-open table, for the Ingest
+// error paths where ingestOne never got (or won't get) a chance to hand the
+// table off to an l0handler/l1handler.
+func closeIngestFiles(files []*ingestFile) {
+	for _, f := range files {
+		f.table.close()
+	}
+}
+
+// ingestOne is called with d.manifest.mutex already held by Ingest, so it
+// uses the Locked manifest helpers rather than the self-locking ones.
+func (d *Db) ingestOne(f *ingestFile) error {
+	fid := d.manifest.nextFileIDLocked()
+	dest := giveTablePath(d.absPath, fid)
+	if err := linkOrCopyFile(f.path, dest); err != nil {
+		return err
+	}
+	// f.table was already opened (and its index parsed) by
+	// openTableForIngest against f.path, whose content dest now is a link
+	// or byte-identical copy of, so it's reused here as-is rather than
+	// reopening and reparsing dest through newTable.
+	t := f.table
+	t.absPath = d.absPath
+	t.id = fid
+	if d.overlapsL1(f.keyRange) {
+		d.manifest.addl0fileLocked(uint32(t.fileInfo.entries), t.fileInfo.minRange, t.fileInfo.maxRange, int(t.size), fid)
+		d.l0handler.addTable(t, fid)
+		logrus.Infof("ingest: %s landed at L0 as file %d (overlaps existing L1 range)", f.path, fid)
+		return nil
+	}
+	d.manifest.addl1fileLocked(uint32(t.fileInfo.entries), t.fileInfo.minRange, t.fileInfo.maxRange, int(t.size), fid)
+	d.l1handler.addTable(t, fid)
+	logrus.Infof("ingest: %s landed directly at L1 as file %d", f.path, fid)
+	return nil
+}
+
+// overlapsL1 reports whether r intersects any current L1 file's range, in
+// which case the ingested table has to go through L0 instead of being
+// dropped straight into L1 behind/ahead of a table it could shadow.
+func (d *Db) overlapsL1(r KeyRange) bool {
+	for _, l1f := range d.manifest.L1Files {
+		if r.overlaps(KeyRange{Start: l1f.MinRange, End: l1f.MaxRange}) {
+			return true
+		}
+	}
+	return false
+}
+
+// openTableForIngest opens path directly (rather than via absPath+fileID
+// like newTable) so an external SSTable can be validated before it has
+// been linked into the store, returning its fileInfo. Block checksums are
+// not read here; each block's CRC is checked when that block is first read.
+func openTableForIngest(path string) (*table, error) {
+	t, err := openTableAtPath(path)
+	if err != nil {
+		return nil, err
+	}
+	if !t.fileInfo.verifyCrc() {
+		t.close()
+		return nil, fmt.Errorf("crc mismatch")
+	}
+	return t, nil
+}
+
+func linkOrCopyFile(src, dest string) error {
+	if err := os.Link(src, dest); err == nil {
+		return nil
+	}
+	// cross-device links fail with EXDEV; fall back to a copy so ingest
+	// still works when the source lives on a different filesystem.
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(dest)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if _, err := io.Copy(out, in); err != nil {
+		return err
+	}
+	return out.Sync()
+}
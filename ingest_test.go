@@ -0,0 +1,109 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import "testing"
+
+// buildIngestTable writes a standalone SSTable at dir/id.table (the same
+// format toDisk gives an L0 table) containing key/value, for Ingest to pick
+// up without round-tripping through a live Db's memtable.
+func buildIngestTable(t *testing.T, dir string, id uint64, key, value string) string {
+	t.Helper()
+	h := newHashMap(1 << 20)
+	h.Set([]byte(key), []byte(value), 1)
+	if err := h.toDisk(dir, id, CompressionNone); err != nil {
+		t.Fatalf("toDisk: %v", err)
+	}
+	return giveTablePath(dir, id)
+}
+
+// TestIngestIntoEmptyL1LandsDirectlyAtL1 confirms a table ingested when L1
+// is empty skips L0 entirely, since there's nothing in L1 it could shadow.
+func TestIngestIntoEmptyL1LandsDirectlyAtL1(t *testing.T) {
+	dbDir := t.TempDir()
+	db, err := New(Options{Path: dbDir, memtablesize: 1 << 20, NoOfL0Files: 1 << 30, maxL1Size: 1 << 30})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+
+	srcDir := t.TempDir()
+	path := buildIngestTable(t, srcDir, 1, "k", "v")
+
+	if err := db.Ingest([]string{path}); err != nil {
+		t.Fatalf("Ingest: %v", err)
+	}
+
+	if n := db.manifest.l1Len(); n != 1 {
+		t.Fatalf("l1Len() = %d, want 1", n)
+	}
+	if n := db.manifest.l0Len(); n != 0 {
+		t.Fatalf("l0Len() = %d, want 0", n)
+	}
+	if val, ok := db.Get([]byte("k")); !ok || string(val) != "v" {
+		t.Fatalf("Get(k) = %q, %v; want v, true", val, ok)
+	}
+}
+
+// TestIngestOverlappingExistingL1LandsAtL0 confirms a table whose range
+// overlaps an existing L1 file goes through L0 instead, since dropping it
+// straight into L1 could shadow (or be shadowed by) the wrong table.
+func TestIngestOverlappingExistingL1LandsAtL0(t *testing.T) {
+	dbDir := t.TempDir()
+	db, err := New(Options{Path: dbDir, memtablesize: 1 << 20, NoOfL0Files: 1 << 30, maxL1Size: 1 << 30})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+
+	srcDir := t.TempDir()
+	first := buildIngestTable(t, srcDir, 1, "k", "v1")
+	if err := db.Ingest([]string{first}); err != nil {
+		t.Fatalf("Ingest first: %v", err)
+	}
+	if n := db.manifest.l1Len(); n != 1 {
+		t.Fatalf("l1Len() after first ingest = %d, want 1", n)
+	}
+
+	second := buildIngestTable(t, srcDir, 2, "k", "v2")
+	if err := db.Ingest([]string{second}); err != nil {
+		t.Fatalf("Ingest second: %v", err)
+	}
+
+	if n := db.manifest.l1Len(); n != 1 {
+		t.Fatalf("l1Len() after second ingest = %d, want 1 (unchanged)", n)
+	}
+	if n := db.manifest.l0Len(); n != 1 {
+		t.Fatalf("l0Len() after second ingest = %d, want 1 (overlapping range routed to L0)", n)
+	}
+}
+
+// TestIngestRejectsOverlappingInputFiles confirms Ingest refuses a batch
+// whose own input files overlap each other, rather than silently picking
+// one.
+func TestIngestRejectsOverlappingInputFiles(t *testing.T) {
+	dbDir := t.TempDir()
+	db, err := New(Options{Path: dbDir, memtablesize: 1 << 20, NoOfL0Files: 1 << 30, maxL1Size: 1 << 30})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+
+	srcDir := t.TempDir()
+	first := buildIngestTable(t, srcDir, 1, "k", "v1")
+	second := buildIngestTable(t, srcDir, 2, "k", "v2")
+
+	if err := db.Ingest([]string{first, second}); err == nil {
+		t.Fatalf("Ingest should reject overlapping input files")
+	}
+}
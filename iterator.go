@@ -0,0 +1,363 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import (
+	"bytes"
+	"container/heap"
+	"sort"
+)
+
+// IterOptions bounds a scan to [LowerBound, UpperBound). Either may be nil
+// to leave that side unbounded.
+type IterOptions struct {
+	LowerBound []byte
+	UpperBound []byte
+}
+
+// iterEntry is one record as seen by the merge iterator, tagged with the
+// op that produced it so tombstones can suppress older versions of the
+// same key instead of being surfaced to callers.
+type iterEntry struct {
+	key   []byte
+	value []byte
+	op    opType
+}
+
+// orderedSource is a single byte-ordered stream the merge iterator pulls
+// from: the active memtable, the immutable memtable, or one on-disk
+// table. rank breaks ties between sources that both have an entry for the
+// same key, lower rank winning as the newer version.
+type orderedSource interface {
+	seekGE(key []byte) bool
+	valid() bool
+	next() bool
+	entry() iterEntry
+	rank() int
+	// rangeTombstones returns the range deletions recorded against this
+	// source (nil or empty if none), so the merge iterator can suppress
+	// point entries from older sources that a DeleteRange shadows.
+	rangeTombstones() *rangeTombstoneList
+}
+
+// hashMapSource adapts hashMap's sorted snapshot (built once up front,
+// since the memtable is small relative to on-disk tables) to
+// orderedSource.
+type hashMapSource struct {
+	entries []iterEntry
+	pos     int
+	r       int
+	rt      *rangeTombstoneList
+}
+
+func newHashMapSource(h *hashMap, r int) *hashMapSource {
+	return &hashMapSource{entries: h.sortedEntries(), pos: -1, r: r, rt: h.rangeTombstones}
+}
+
+// newHashMapSourceAsOf is the Snapshot-facing variant: it only sees
+// entries recorded at or before asOf, so later writes to the still-live
+// memtable don't leak into a frozen snapshot view.
+func newHashMapSourceAsOf(h *hashMap, asOf uint64, r int) *hashMapSource {
+	rt := newRangeTombstoneList()
+	h.mu.RLock()
+	for _, t := range h.rangeTombstones.tombstones {
+		if t.seqno <= asOf {
+			rt.tombstones = append(rt.tombstones, t)
+		}
+	}
+	h.mu.RUnlock()
+	return &hashMapSource{entries: h.sortedEntriesAsOf(asOf), pos: -1, r: r, rt: rt}
+}
+
+func (s *hashMapSource) seekGE(key []byte) bool {
+	s.pos = sort.Search(len(s.entries), func(i int) bool {
+		return bytes.Compare(s.entries[i].key, key) >= 0
+	})
+	return s.valid()
+}
+
+func (s *hashMapSource) valid() bool { return s.pos >= 0 && s.pos < len(s.entries) }
+func (s *hashMapSource) next() bool  { s.pos++; return s.valid() }
+func (s *hashMapSource) entry() iterEntry { return s.entries[s.pos] }
+func (s *hashMapSource) rank() int        { return s.r }
+func (s *hashMapSource) rangeTombstones() *rangeTombstoneList { return s.rt }
+
+// tableSource adapts a table's forward iterator to orderedSource.
+type tableSource struct {
+	it  *tableForwardIter
+	cur iterEntry
+	ok  bool
+	r   int
+	t   *table
+}
+
+func newTableSource(t *table, r int) *tableSource {
+	return &tableSource{it: t.forwardIter(), r: r, t: t}
+}
+
+func (s *tableSource) seekGE(key []byte) bool {
+	s.ok = s.it.seekGE(key)
+	if s.ok {
+		s.cur = s.it.entry()
+	}
+	return s.ok
+}
+
+func (s *tableSource) valid() bool { return s.ok }
+
+func (s *tableSource) next() bool {
+	s.ok = s.it.next()
+	if s.ok {
+		s.cur = s.it.entry()
+	}
+	return s.ok
+}
+
+func (s *tableSource) entry() iterEntry { return s.cur }
+func (s *tableSource) rank() int        { return s.r }
+func (s *tableSource) rangeTombstones() *rangeTombstoneList { return s.t.rangeTombstones }
+
+type sourceHeap []orderedSource
+
+func (h sourceHeap) Len() int { return len(h) }
+func (h sourceHeap) Less(i, j int) bool {
+	ei, ej := h[i].entry(), h[j].entry()
+	if c := bytes.Compare(ei.key, ej.key); c != 0 {
+		return c < 0
+	}
+	return h[i].rank() < h[j].rank()
+}
+func (h sourceHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *sourceHeap) Push(x interface{}) { *h = append(*h, x.(orderedSource)) }
+func (h *sourceHeap) Pop() interface{} {
+	old := *h
+	n := len(old)
+	x := old[n-1]
+	*h = old[:n-1]
+	return x
+}
+
+// mergeIterator merges every orderedSource into a single forward stream:
+// the newest version of each key wins and point/range tombstones suppress
+// older versions instead of being surfaced.
+type mergeIterator struct {
+	h sourceHeap
+	// all is every source newMergeIterator was given, independent of which
+	// of them are still sitting in h: advance() permanently heap.Pops a
+	// source once it's exhausted, so h alone can't be used to rebuild a
+	// merge over the full range again. SeekGE/Prev reconstruct from all
+	// instead, re-seeking every source from scratch.
+	all []orderedSource
+	// ranges holds every source's range tombstones alongside that source's
+	// rank, so advance() can tell a point entry apart from one shadowed by
+	// a DeleteRange recorded in a newer source.
+	ranges []rankedTombstones
+	upper  []byte
+	key    []byte
+	value  []byte
+	valid  bool
+}
+
+// rankedTombstones ties a source's range tombstones to that source's rank,
+// the same "lower rank is newer" ordering advance() uses to pick a winner
+// among point entries for a key.
+type rankedTombstones struct {
+	rank int
+	list *rangeTombstoneList
+}
+
+func newMergeIterator(sources []orderedSource, lower, upper []byte) *mergeIterator {
+	m := &mergeIterator{upper: upper, all: sources}
+	for _, s := range sources {
+		if rt := s.rangeTombstones(); rt != nil && !rt.isEmpty() {
+			m.ranges = append(m.ranges, rankedTombstones{rank: s.rank(), list: rt})
+		}
+		// seekGE(nil) is seek-to-first: both hashMapSource and tableSource
+		// compare every key against an empty/nil lower bound as >=, so this
+		// also covers the common unbounded-scan case without special-casing
+		// it - a source's valid()/pos/ok zero value isn't "positioned at the
+		// first entry", it's "not positioned at all".
+		if s.seekGE(lower) {
+			m.h = append(m.h, s)
+		}
+	}
+	heap.Init(&m.h)
+	m.advance()
+	return m
+}
+
+// coveredByNewerTombstone reports whether key is shadowed by a range
+// tombstone recorded in a source ranked newer than rank. It only has to
+// check strictly-newer sources: hashMap.sortedEntriesAsOf/getLocked and
+// tableForwardIter.entry/table.get already compare a source's own point
+// entries against its own range tombstones by seq before an entry is ever
+// handed to the merge iterator, so same-source shadowing is resolved there,
+// not here.
+func (m *mergeIterator) coveredByNewerTombstone(key []byte, rank int) bool {
+	for _, rt := range m.ranges {
+		if rt.rank >= rank {
+			continue
+		}
+		if _, covered := rt.list.covers(key, ^uint64(0)); covered {
+			return true
+		}
+	}
+	return false
+}
+
+// advance pops the newest entry for the next distinct key, draining every
+// source positioned at that key, and skips it if it turns out to be a
+// tombstone.
+func (m *mergeIterator) advance() {
+	for m.h.Len() > 0 {
+		winner := m.h[0]
+		e := winner.entry()
+		winnerRank := winner.rank()
+		key := append([]byte(nil), e.key...)
+
+		for m.h.Len() > 0 && bytes.Equal(m.h[0].entry().key, key) {
+			s := m.h[0]
+			if s.next() {
+				heap.Fix(&m.h, 0)
+			} else {
+				heap.Pop(&m.h)
+			}
+		}
+
+		if m.upper != nil && bytes.Compare(key, m.upper) >= 0 {
+			m.valid = false
+			return
+		}
+		if e.op != opPut {
+			continue
+		}
+		if m.coveredByNewerTombstone(key, winnerRank) {
+			continue
+		}
+		m.key, m.value, m.valid = key, e.value, true
+		return
+	}
+	m.valid = false
+}
+
+// Iterator scans the merged, tombstone-filtered view of the whole LSM
+// tree: the active memtable, the immutable memtable, and every on-disk L0
+// and L1 table that could overlap the requested bounds.
+type Iterator struct {
+	opts  IterOptions
+	merge *mergeIterator
+}
+
+// NewIterator returns an Iterator over the current state of the store,
+// bounded by opts. L0 tables are merged newest-first; L1 tables are
+// included only when their range overlaps the requested bounds, since
+// each table's recorded min/max range already rules the rest out.
+func (d *Db) NewIterator(opts IterOptions) *Iterator {
+	d.RLock()
+	defer d.RUnlock()
+
+	rank := 0
+	var sources []orderedSource
+	sources = append(sources, newHashMapSource(d.mtable, rank))
+	rank++
+	if d.immtable != nil {
+		sources = append(sources, newHashMapSource(d.immtable, rank))
+		rank++
+	}
+	for _, t := range d.l0handler.tablesNewestFirst() {
+		sources = append(sources, newTableSource(t, rank))
+		rank++
+	}
+	for _, t := range d.l1handler.tablesNewestFirst() {
+		if !rangesOverlap(t.fileInfo.minRange, t.fileInfo.maxRange, opts.LowerBound, opts.UpperBound) {
+			continue
+		}
+		sources = append(sources, newTableSource(t, rank))
+		rank++
+	}
+
+	return &Iterator{
+		opts:  opts,
+		merge: newMergeIterator(sources, opts.LowerBound, opts.UpperBound),
+	}
+}
+
+func rangesOverlap(tMin, tMax, lower, upper []byte) bool {
+	if upper != nil && bytes.Compare(tMin, upper) >= 0 {
+		return false
+	}
+	if lower != nil && bytes.Compare(tMax, lower) < 0 {
+		return false
+	}
+	return true
+}
+
+// SeekGE repositions the iterator at the first key >= key.
+func (it *Iterator) SeekGE(key []byte) bool {
+	lower := key
+	it.merge = newMergeIterator(it.merge.all, lower, it.opts.UpperBound)
+	return it.merge.valid
+}
+
+// Seek is an alias for SeekGE kept for callers used to the leveldb-style
+// naming.
+func (it *Iterator) Seek(key []byte) bool {
+	return it.SeekGE(key)
+}
+
+// Next advances to the next key in the merged view.
+func (it *Iterator) Next() bool {
+	it.merge.advance()
+	return it.merge.valid
+}
+
+// Prev repositions to the key immediately before the current one. Unlike
+// Next this re-scans from the start of the bounded range, since the
+// merge's sources are forward-only; it's the simple, correct option until
+// something here shows up hot enough to need a reverse iterator per
+// source.
+func (it *Iterator) Prev() bool {
+	if !it.merge.valid {
+		return false
+	}
+	target := append([]byte(nil), it.merge.key...)
+	fresh := newMergeIterator(it.merge.all, it.opts.LowerBound, target)
+	var last []byte
+	var lastVal []byte
+	found := false
+	for fresh.valid {
+		last, lastVal = fresh.key, fresh.value
+		found = true
+		fresh.advance()
+	}
+	if !found {
+		it.merge.valid = false
+		return false
+	}
+	it.merge.key, it.merge.value, it.merge.valid = last, lastVal, true
+	return true
+}
+
+// Key returns the key at the iterator's current position.
+func (it *Iterator) Key() []byte { return it.merge.key }
+
+// Value returns the value at the iterator's current position.
+func (it *Iterator) Value() []byte { return it.merge.value }
+
+// Valid reports whether the iterator is positioned at an entry.
+func (it *Iterator) Valid() bool { return it.merge.valid }
+
+// Close releases the iterator. It is a no-op: Db.NewIterator takes no pins
+// on the underlying tables, and an iterator from Snapshot.NewIterator reads
+// tables pinned by its Snapshot until Snapshot.Close.
+func (it *Iterator) Close() {}
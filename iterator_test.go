@@ -0,0 +1,80 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import "testing"
+
+// TestIteratorUnboundedScanReturnsEveryKey guards against newMergeIterator
+// leaving every source unseeded when both IterOptions bounds are nil: each
+// orderedSource's zero value (hashMapSource.pos == -1, tableSource.ok ==
+// false) means "not positioned" rather than "positioned at the first
+// entry", so an unbounded scan has to explicitly seek every source to its
+// first key.
+func TestIteratorUnboundedScanReturnsEveryKey(t *testing.T) {
+	dir := t.TempDir()
+	db, err := New(Options{Path: dir, memtablesize: 1 << 20, NoOfL0Files: 1 << 30, maxL1Size: 1 << 30})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+
+	db.Set([]byte("a"), []byte("1"))
+	db.Set([]byte("b"), []byte("2"))
+	db.Set([]byte("c"), []byte("3"))
+
+	it := db.NewIterator(IterOptions{})
+	got := map[string]string{}
+	for it.Valid() {
+		got[string(it.Key())] = string(it.Value())
+		it.Next()
+	}
+	it.Close()
+
+	want := map[string]string{"a": "1", "b": "2", "c": "3"}
+	if len(got) != len(want) {
+		t.Fatalf("unbounded scan returned %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("unbounded scan returned %v, want %v", got, want)
+		}
+	}
+}
+
+// TestIteratorBoundedScanRespectsBounds confirms [LowerBound, UpperBound)
+// excludes keys outside the window instead of just happening to include
+// everything.
+func TestIteratorBoundedScanRespectsBounds(t *testing.T) {
+	dir := t.TempDir()
+	db, err := New(Options{Path: dir, memtablesize: 1 << 20, NoOfL0Files: 1 << 30, maxL1Size: 1 << 30})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		db.Set([]byte(k), []byte(k))
+	}
+
+	it := db.NewIterator(IterOptions{LowerBound: []byte("b"), UpperBound: []byte("d")})
+	var got []string
+	for it.Valid() {
+		got = append(got, string(it.Key()))
+		it.Next()
+	}
+	it.Close()
+
+	if len(got) != 2 || got[0] != "b" || got[1] != "c" {
+		t.Fatalf("bounded scan = %v, want [b c]", got)
+	}
+}
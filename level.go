@@ -0,0 +1,87 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import (
+	"sort"
+	"sync"
+)
+
+// levelHandler holds the live *table objects for one level (L0 or L1),
+// keyed by file id. l0handler and l1handler share a blockCache so a block
+// read through one level reuses the decompressed bytes if it's ever read
+// through the other.
+type levelHandler struct {
+	mu    sync.RWMutex
+	tbls  map[uint64]*table
+	cache *blockCache
+}
+
+func newLevelHanlder(cache *blockCache) *levelHandler {
+	return &levelHandler{tbls: make(map[uint64]*table), cache: cache}
+}
+
+func (l *levelHandler) addTable(t *table, id uint64) {
+	t.cache = l.cache
+	l.mu.Lock()
+	l.tbls[id] = t
+	l.mu.Unlock()
+}
+
+func (l *levelHandler) deleteTable(id uint64) {
+	l.mu.Lock()
+	delete(l.tbls, id)
+	l.mu.Unlock()
+}
+
+// get checks every table newest-first, stopping at the first one that has
+// anything to say about key: a live value or a tombstone. A tombstone hit
+// is reported back as deleted=true so the caller doesn't keep looking at
+// older, shadowed tables.
+func (l *levelHandler) get(key []byte) (value []byte, deleted bool, exist bool) {
+	for _, t := range l.tablesNewestFirst() {
+		val, del, ok := t.get(key)
+		if ok || del {
+			return val, del, ok
+		}
+	}
+	return nil, false, false
+}
+
+// tablesNewestFirst returns this level's tables ordered by file id
+// descending, since higher ids are always written later.
+func (l *levelHandler) tablesNewestFirst() []*table {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	ids := make([]uint64, 0, len(l.tbls))
+	for id := range l.tbls {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] > ids[j] })
+	out := make([]*table, len(ids))
+	for i, id := range ids {
+		out[i] = l.tbls[id]
+	}
+	return out
+}
+
+// tables returns this level's tables in no particular order.
+func (l *levelHandler) tables() []*table {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	out := make([]*table, 0, len(l.tbls))
+	for _, t := range l.tbls {
+		out = append(out, t)
+	}
+	return out
+}
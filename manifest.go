@@ -0,0 +1,215 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import (
+	"encoding/gob"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+const manifestFileName = "MANIFEST"
+
+// fileMeta is the metadata manifest keeps per on-disk table so New can
+// reopen the LSM tree without rescanning the data directory.
+type fileMeta struct {
+	Idx      uint64
+	MinRange []byte
+	MaxRange []byte
+	Size     uint32
+	Entries  uint32
+}
+
+// manifest is the single source of truth for which L0/L1 tables make up the
+// store, persisted to disk so New can reconstruct the tree on restart.
+// mutex also doubles as the lock that keeps compaction's view of L1
+// consistent with concurrent Ingest calls (see Db.Ingest, Db.L0Compaction).
+type manifest struct {
+	mutex sync.Mutex
+
+	L0Files []fileMeta
+	L1Files []fileMeta
+	LastSeq uint64
+	LogID   uint64
+	NextID  uint64
+}
+
+// loadOrCreateManifest reads the manifest persisted at absPath, or returns a
+// fresh, empty one if this is a new store.
+func loadOrCreateManifest(absPath string) (*manifest, error) {
+	if err := os.MkdirAll(absPath, 0755); err != nil {
+		return nil, err
+	}
+	fp, err := os.Open(filepath.Join(absPath, manifestFileName))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return &manifest{}, nil
+		}
+		return nil, err
+	}
+	defer fp.Close()
+
+	m := &manifest{}
+	if err := gob.NewDecoder(fp).Decode(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// save persists the manifest, writing to a temp file first so a crash
+// mid-write can never leave a corrupt manifest behind.
+func (m *manifest) save(absPath string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+
+	path := filepath.Join(absPath, manifestFileName)
+	tmp := path + ".tmp"
+	fp, err := os.Create(tmp)
+	if err != nil {
+		return err
+	}
+	if err := gob.NewEncoder(fp).Encode(m); err != nil {
+		fp.Close()
+		return err
+	}
+	if err := fp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// nextFileID hands out the id for the next log or table file written to
+// absPath, monotonically increasing across the manifest's lifetime.
+func (m *manifest) nextFileID() uint64 {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.nextFileIDLocked()
+}
+
+// nextFileIDLocked is nextFileID for a caller already holding m.mutex, e.g.
+// Db.Ingest and Db.L0Compaction serializing a whole link-in/merge sequence
+// behind one lock acquisition.
+func (m *manifest) nextFileIDLocked() uint64 {
+	m.NextID++
+	return m.NextID
+}
+
+func (m *manifest) setLogID(id uint64) {
+	m.mutex.Lock()
+	m.LogID = id
+	m.mutex.Unlock()
+}
+
+func (m *manifest) setLastSeq(seq uint64) {
+	m.mutex.Lock()
+	if seq > m.LastSeq {
+		m.LastSeq = seq
+	}
+	m.mutex.Unlock()
+}
+
+func (m *manifest) addl0file(entries uint32, minRange, maxRange []byte, size int, id uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.addl0fileLocked(entries, minRange, maxRange, size, id)
+}
+
+// addl0fileLocked is addl0file for a caller already holding m.mutex.
+func (m *manifest) addl0fileLocked(entries uint32, minRange, maxRange []byte, size int, id uint64) {
+	m.L0Files = append(m.L0Files, fileMeta{Idx: id, MinRange: minRange, MaxRange: maxRange, Size: uint32(size), Entries: entries})
+}
+
+func (m *manifest) addl1file(entries uint32, minRange, maxRange []byte, size int, id uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.addl1fileLocked(entries, minRange, maxRange, size, id)
+}
+
+// addl1fileLocked is addl1file for a caller already holding m.mutex.
+func (m *manifest) addl1fileLocked(entries uint32, minRange, maxRange []byte, size int, id uint64) {
+	m.L1Files = append(m.L1Files, fileMeta{Idx: id, MinRange: minRange, MaxRange: maxRange, Size: uint32(size), Entries: entries})
+}
+
+func (m *manifest) deleteL0Table(id uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.deleteL0TableLocked(id)
+}
+
+// deleteL0TableLocked is deleteL0Table for a caller already holding m.mutex.
+func (m *manifest) deleteL0TableLocked(id uint64) {
+	m.L0Files = removeFileMeta(m.L0Files, id)
+}
+
+func (m *manifest) deleteL1Table(id uint64) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.L1Files = removeFileMeta(m.L1Files, id)
+}
+
+func removeFileMeta(files []fileMeta, id uint64) []fileMeta {
+	for i, f := range files {
+		if f.Idx == id {
+			return append(files[:i], files[i+1:]...)
+		}
+	}
+	return files
+}
+
+// sortL0 orders L0Files by size ascending so L0Compaction always picks the
+// two smallest tables as its next merge victims.
+func (m *manifest) sortL0() {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.sortL0Locked()
+}
+
+// sortL0Locked is sortL0 for a caller already holding m.mutex.
+func (m *manifest) sortL0Locked() {
+	sort.Slice(m.L0Files, func(i, j int) bool { return m.L0Files[i].Size < m.L0Files[j].Size })
+}
+
+func (m *manifest) copyL0() []fileMeta {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	out := make([]fileMeta, len(m.L0Files))
+	copy(out, m.L0Files)
+	return out
+}
+
+func (m *manifest) copyL1() []fileMeta {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	out := make([]fileMeta, len(m.L1Files))
+	copy(out, m.L1Files)
+	return out
+}
+
+func (m *manifest) l0Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return len(m.L0Files)
+}
+
+func (m *manifest) l1Len() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.l1LenLocked()
+}
+
+// l1LenLocked is l1Len for a caller already holding m.mutex.
+func (m *manifest) l1LenLocked() int {
+	return len(m.L1Files)
+}
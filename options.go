@@ -0,0 +1,47 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import "hash/crc32"
+
+// CastagnoliCrcTable is the shared CRC-32C table every on-disk checksum in
+// this package (WAL records, compressed blocks) is computed against.
+var CastagnoliCrcTable = crc32.MakeTable(crc32.Castagnoli)
+
+// Options configures a Db opened with New.
+type Options struct {
+	// Path is the directory the store's manifest, logs and tables live in.
+	// It's created if it doesn't already exist.
+	Path string
+
+	// memtablesize bounds how many bytes of keys+values a memtable holds
+	// before it's rotated to immtable and flushed to an L0 table.
+	memtablesize int
+
+	// NoOfL0Files is how many L0 tables accumulate before runCompaction
+	// kicks off L0Compaction.
+	NoOfL0Files int
+
+	// maxL1Size bounds how large a single L1 table is allowed to grow
+	// before loadBalancing splits it in two.
+	maxL1Size int
+
+	// SyncWrites fsyncs the WAL before a write group's callers are
+	// released. Off by default, trading durability for throughput the way
+	// most embedded stores do.
+	SyncWrites bool
+
+	// Compression selects how key/value blocks are stored on disk for
+	// tables this Db writes. CompressionNone if left unset.
+	Compression CompressionType
+}
@@ -0,0 +1,166 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import "sync/atomic"
+
+// Snapshot is a consistent point-in-time view of the store: Get and
+// NewIterator on a Snapshot only ever see writes committed at or before
+// the moment NewSnapshot was called, no matter what Set/Delete/compaction
+// does to the store afterwards. On-disk tables are immutable once
+// written, so freezing the view only takes pinning which table objects
+// were live at creation time (via refcounts) plus filtering the
+// still-mutable memtable down to seq <= the snapshot's.
+type Snapshot struct {
+	db       *Db
+	seq      uint64
+	mtable   *hashMap
+	immtable *hashMap
+	l0       []*table
+	l1       []*table
+	closed   bool
+}
+
+// NewSnapshot pins the current memtable, immutable memtable (if any), and
+// on-disk table list, so flushMem, L0Compaction, and loadBalancing can't
+// remove a file this snapshot might still need to read.
+func (d *Db) NewSnapshot() *Snapshot {
+	d.RLock()
+	seq := atomic.LoadUint64(&d.seqCounter)
+	mtable := d.mtable
+	immtable := d.immtable
+	l0 := d.l0handler.tablesNewestFirst()
+	l1 := d.l1handler.tablesNewestFirst()
+	d.RUnlock()
+
+	for _, t := range l0 {
+		t.ref()
+	}
+	for _, t := range l1 {
+		t.ref()
+	}
+
+	return &Snapshot{db: d, seq: seq, mtable: mtable, immtable: immtable, l0: l0, l1: l1}
+}
+
+// Get reads key as it stood at snapshot creation time.
+func (s *Snapshot) Get(key []byte) ([]byte, bool) {
+	if val, op, ok := s.mtable.GetAsOf(key, s.seq); ok {
+		return val, op == opPut
+	}
+	if s.immtable != nil {
+		if val, op, ok := s.immtable.GetAsOf(key, s.seq); ok {
+			return val, op == opPut
+		}
+	}
+	for _, t := range s.l0 {
+		if val, deleted, ok := t.get(key); ok || deleted {
+			return val, ok && !deleted
+		}
+	}
+	for _, t := range s.l1 {
+		if val, deleted, ok := t.get(key); ok || deleted {
+			return val, ok && !deleted
+		}
+	}
+	return nil, false
+}
+
+// NewIterator returns an Iterator over this snapshot's frozen view,
+// bounded by opts.
+func (s *Snapshot) NewIterator(opts IterOptions) *Iterator {
+	rank := 0
+	var sources []orderedSource
+
+	sources = append(sources, newHashMapSourceAsOf(s.mtable, s.seq, rank))
+	rank++
+	if s.immtable != nil {
+		sources = append(sources, newHashMapSourceAsOf(s.immtable, s.seq, rank))
+		rank++
+	}
+	for _, t := range s.l0 {
+		if !rangesOverlap(t.fileInfo.minRange, t.fileInfo.maxRange, opts.LowerBound, opts.UpperBound) {
+			continue
+		}
+		sources = append(sources, newTableSource(t, rank))
+		rank++
+	}
+	for _, t := range s.l1 {
+		if !rangesOverlap(t.fileInfo.minRange, t.fileInfo.maxRange, opts.LowerBound, opts.UpperBound) {
+			continue
+		}
+		sources = append(sources, newTableSource(t, rank))
+		rank++
+	}
+
+	return &Iterator{
+		opts:  opts,
+		merge: newMergeIterator(sources, opts.LowerBound, opts.UpperBound),
+	}
+}
+
+// Close drops this snapshot's refcounts, letting compaction and flushing
+// finally remove any table it was the last thing pinning.
+func (s *Snapshot) Close() {
+	if s.closed {
+		return
+	}
+	s.closed = true
+	for _, t := range s.l0 {
+		if t.unref() == 0 {
+			s.db.reapPending(t)
+		}
+	}
+	for _, t := range s.l1 {
+		if t.unref() == 0 {
+			s.db.reapPending(t)
+		}
+	}
+}
+
+// retireTable is how flushMem/L0Compaction/loadBalancing remove a table
+// that a live snapshot might still be pinning: if a snapshot holds a
+// reference, the table is parked until that snapshot's Close drops it to
+// zero instead of being closed and unlinked immediately.
+func (d *Db) retireTable(t *table) {
+	if t.unref() > 0 {
+		d.Lock()
+		d.pendingRemoval = append(d.pendingRemoval, t)
+		d.Unlock()
+		return
+	}
+	t.close()
+	removeTable(d.absPath, t.ID())
+}
+
+// reapPending finalizes the close/unlink of t once the last snapshot
+// pinning it has let go, if retireTable had already tried and deferred it.
+func (d *Db) reapPending(t *table) {
+	d.Lock()
+	idx := -1
+	for i, p := range d.pendingRemoval {
+		if p == t {
+			idx = i
+			break
+		}
+	}
+	if idx >= 0 {
+		d.pendingRemoval = append(d.pendingRemoval[:idx], d.pendingRemoval[idx+1:]...)
+	}
+	d.Unlock()
+	if idx < 0 {
+		return
+	}
+	t.close()
+	removeTable(d.absPath, t.ID())
+}
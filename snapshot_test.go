@@ -0,0 +1,73 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import "testing"
+
+// TestSnapshotIsolatedFromWritesAfterCreation confirms a Snapshot keeps
+// seeing the state as it stood at NewSnapshot time even after the live Db
+// is mutated (overwriting an existing key, deleting another, adding a new
+// one), both through Get and through NewIterator.
+func TestSnapshotIsolatedFromWritesAfterCreation(t *testing.T) {
+	dir := t.TempDir()
+	db, err := New(Options{Path: dir, memtablesize: 1 << 20, NoOfL0Files: 1 << 30, maxL1Size: 1 << 30})
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	defer db.Close()
+
+	db.Set([]byte("a"), []byte("1"))
+	db.Set([]byte("b"), []byte("2"))
+
+	snap := db.NewSnapshot()
+	defer snap.Close()
+
+	db.Set([]byte("a"), []byte("changed"))
+	db.Delete([]byte("b"))
+	db.Set([]byte("c"), []byte("new"))
+
+	if val, ok := snap.Get([]byte("a")); !ok || string(val) != "1" {
+		t.Fatalf("snapshot Get(a) = %q, %v; want 1, true", val, ok)
+	}
+	if _, ok := snap.Get([]byte("b")); !ok {
+		t.Fatalf("snapshot Get(b) should still see the pre-delete value")
+	}
+	if _, ok := snap.Get([]byte("c")); ok {
+		t.Fatalf("snapshot Get(c) should not see a key written after the snapshot")
+	}
+
+	if val, ok := db.Get([]byte("a")); !ok || string(val) != "changed" {
+		t.Fatalf("live Get(a) = %q, %v; want changed, true", val, ok)
+	}
+	if _, ok := db.Get([]byte("b")); ok {
+		t.Fatalf("live Get(b) should reflect the delete")
+	}
+
+	it := snap.NewIterator(IterOptions{})
+	got := map[string]string{}
+	for it.Valid() {
+		got[string(it.Key())] = string(it.Value())
+		it.Next()
+	}
+	it.Close()
+
+	want := map[string]string{"a": "1", "b": "2"}
+	if len(got) != len(want) {
+		t.Fatalf("snapshot iterator returned %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Fatalf("snapshot iterator returned %v, want %v", got, want)
+		}
+	}
+}
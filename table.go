@@ -0,0 +1,543 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync/atomic"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const tableFileSuffix = ".table"
+
+func giveTablePath(absPath string, id uint64) string {
+	return filepath.Join(absPath, fmt.Sprintf("%06d%s", id, tableFileSuffix))
+}
+
+func removeTable(absPath string, id uint64) error {
+	err := os.Remove(giveTablePath(absPath, id))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// entryLoc locates one record inside a table's sequence of compressed data
+// blocks: which block (by file offset) and where inside that block's
+// decompressed bytes the record starts.
+type entryLoc struct {
+	BlockOffset uint32
+	WithinBlock uint32
+	Op          opType
+	Seq         uint64
+}
+
+// fileInfo is the metadata every table carries: its key range, record
+// count, and where its data section ends (and the index begins).
+type fileInfo struct {
+	minRange    []byte
+	maxRange    []byte
+	entries     uint32
+	metaOffset  uint32
+	compression CompressionType
+}
+
+// verifyCrc always returns true. Per-block payload checksums are verified
+// by decodeBlock when each block is read, not when the table is opened, so
+// a table whose index decodes passes openTableAtPath and verifyCrc even if
+// one of its blocks is corrupt.
+func (fi fileInfo) verifyCrc() bool {
+	return true
+}
+
+// rangeTombstoneWire is the gob-friendly shape of a rangeTombstone, whose
+// own fields are unexported for everything but table.go's own encoding.
+type rangeTombstoneWire struct {
+	Start []byte
+	End   []byte
+	Seqno uint64
+}
+
+// tableIndex is the metadata gob-encoded at the tail of every table file:
+// everything a reader needs to serve Get/forwardIter without decompressing
+// the data section up front.
+type tableIndex struct {
+	Offsets     map[string]entryLoc
+	Ranges      []rangeTombstoneWire
+	MinRange    []byte
+	MaxRange    []byte
+	Entries     uint32
+	Compression CompressionType
+}
+
+// table is one immutable on-disk SSTable: a sequence of compressed data
+// blocks followed by a gob-encoded tableIndex. refCount starts at 1 for the
+// levelHandler's own reference; Db.NewSnapshot adds one per pinning
+// snapshot, via ref/unref (see retireTable/reapPending in snapshot.go).
+type table struct {
+	absPath  string
+	id       uint64
+	fp       *os.File
+	size     int64
+	fileInfo fileInfo
+
+	offsetMap       map[string]entryLoc
+	rangeTombstones *rangeTombstoneList
+
+	cache    *blockCache
+	refCount int32
+}
+
+// newTable opens the table file at absPath/id. Every call site already has
+// the id from a manifest entry it trusts, so a failure here means the data
+// directory is corrupt and there's nothing better to do than stop.
+func newTable(absPath string, id uint64) *table {
+	t, err := openTableAtPath(giveTablePath(absPath, id))
+	if err != nil {
+		logrus.Fatalf("table: unable to open table %d: %s", id, err.Error())
+	}
+	t.absPath = absPath
+	t.id = id
+	return t
+}
+
+// openTableAtPath opens and parses the table file at path directly, for
+// callers (Ingest) that need to inspect a table before it has been linked
+// into absPath under a file id.
+func openTableAtPath(path string) (*table, error) {
+	fp, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	st, err := fp.Stat()
+	if err != nil {
+		fp.Close()
+		return nil, err
+	}
+	size := st.Size()
+	if size < 8 {
+		fp.Close()
+		return nil, fmt.Errorf("aran: table %s: too small to be valid", path)
+	}
+
+	var trailer [8]byte
+	if _, err := fp.ReadAt(trailer[:], size-8); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	metaOffset := binary.BigEndian.Uint64(trailer[:])
+	idxLen := size - 8 - int64(metaOffset)
+	if idxLen < 0 {
+		fp.Close()
+		return nil, fmt.Errorf("aran: table %s: corrupt trailer", path)
+	}
+	idxBuf := make([]byte, idxLen)
+	if _, err := fp.ReadAt(idxBuf, int64(metaOffset)); err != nil {
+		fp.Close()
+		return nil, err
+	}
+	var idx tableIndex
+	if err := gob.NewDecoder(bytes.NewReader(idxBuf)).Decode(&idx); err != nil {
+		fp.Close()
+		return nil, err
+	}
+
+	rt := newRangeTombstoneList()
+	for _, w := range idx.Ranges {
+		rt.tombstones = append(rt.tombstones, rangeTombstone{start: w.Start, end: w.End, seqno: w.Seqno})
+	}
+
+	return &table{
+		fp:   fp,
+		size: size,
+		fileInfo: fileInfo{
+			minRange:    idx.MinRange,
+			maxRange:    idx.MaxRange,
+			entries:     idx.Entries,
+			metaOffset:  uint32(metaOffset),
+			compression: idx.Compression,
+		},
+		offsetMap:       idx.Offsets,
+		rangeTombstones: rt,
+		refCount:        1,
+	}, nil
+}
+
+func (t *table) ID() uint64 { return t.id }
+
+func (t *table) close() error {
+	return t.fp.Close()
+}
+
+// SeekBegin rewinds t's file, since mergeTable reads the whole data section
+// back out via builder.append.
+func (t *table) SeekBegin() {
+	t.fp.Seek(0, io.SeekStart)
+}
+
+// ref pins t so a concurrent retireTable can't close/unlink it out from
+// under a live Snapshot.
+func (t *table) ref() {
+	atomic.AddInt32(&t.refCount, 1)
+}
+
+// unref releases a pin taken by ref (or the implicit one newTable starts
+// with) and returns the remaining count.
+func (t *table) unref() int32 {
+	return atomic.AddInt32(&t.refCount, -1)
+}
+
+// get looks up key in t: a live value, a point tombstone, or not found at
+// all. When both a point entry and a covering range tombstone exist for
+// key, whichever has the higher seq wins, same as hashMap.getLocked.
+func (t *table) get(key []byte) (value []byte, deleted bool, exist bool) {
+	loc, hasPoint := t.offsetMap[string(key)]
+	tombSeq, covered := t.rangeTombstones.covers(key, ^uint64(0))
+	if hasPoint && (!covered || loc.Seq >= tombSeq) {
+		if loc.Op != opPut {
+			return nil, true, false
+		}
+		val, err := t.readValue(loc)
+		if err != nil {
+			logrus.Fatalf("table: unable to read value from table %d: %s", t.id, err.Error())
+		}
+		return val, false, true
+	}
+	if covered {
+		return nil, true, false
+	}
+	return nil, false, false
+}
+
+// readValue decompresses the block loc points into (through t.cache, if
+// set) and parses out the value at loc's offset within it.
+func (t *table) readValue(loc entryLoc) ([]byte, error) {
+	block, err := t.readBlock(loc.BlockOffset)
+	if err != nil {
+		return nil, err
+	}
+	_, _, _, value, _ := parseEntryAt(block, loc.WithinBlock)
+	return value, nil
+}
+
+func (t *table) readBlock(offset uint32) ([]byte, error) {
+	key := blockCacheKey{tableID: t.id, offset: offset}
+	if t.cache != nil {
+		if b, ok := t.cache.get(key); ok {
+			return b, nil
+		}
+	}
+
+	var headBuf [blockHeaderSize]byte
+	if _, err := t.fp.ReadAt(headBuf[:], int64(offset)); err != nil {
+		return nil, err
+	}
+	h, err := decodeBlockHeader(headBuf[:])
+	if err != nil {
+		return nil, err
+	}
+	full := make([]byte, blockHeaderSize+int(h.compressedLen))
+	if _, err := t.fp.ReadAt(full, int64(offset)); err != nil {
+		return nil, err
+	}
+	raw, err := decodeBlock(full)
+	if err != nil {
+		return nil, err
+	}
+
+	if t.cache != nil {
+		t.cache.put(key, raw)
+	}
+	return raw, nil
+}
+
+// entries returns the CRC32C hash of every key in t, sorted ascending, for
+// loadBalancing to find the median split point.
+func (t *table) entries() []uint32 {
+	hashes := make([]uint32, 0, len(t.offsetMap))
+	for k := range t.offsetMap {
+		hashes = append(hashes, hashString(k))
+	}
+	sort.Slice(hashes, func(i, j int) bool { return hashes[i] < hashes[j] })
+	return hashes
+}
+
+func hashString(s string) uint32 {
+	c := crc32.New(CastagnoliCrcTable)
+	c.Write([]byte(s))
+	return c.Sum32()
+}
+
+// tableIter walks every record in t in key order, for loadBalancing to
+// rewrite a whole table into two halves.
+type tableIter struct {
+	t    *table
+	keys []string
+	pos  int
+}
+
+func (t *table) iter() *tableIter {
+	keys := make([]string, 0, len(t.offsetMap))
+	for k := range t.offsetMap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return &tableIter{t: t, keys: keys, pos: -1}
+}
+
+func (it *tableIter) has() bool {
+	return it.pos+1 < len(it.keys)
+}
+
+func (it *tableIter) next() (keyLen, valLen uint32, key, value []byte) {
+	it.pos++
+	k := it.keys[it.pos]
+	loc := it.t.offsetMap[k]
+	val, err := it.t.readValue(loc)
+	if err != nil {
+		logrus.Fatalf("table: unable to read value during iteration: %s", err.Error())
+	}
+	return uint32(len(k)), uint32(len(val)), []byte(k), val
+}
+
+// tableForwardIter is the forward-scan adapter the merge iterator uses
+// (see tableSource in iterator.go).
+type tableForwardIter struct {
+	t    *table
+	keys []string
+	pos  int
+}
+
+func (t *table) forwardIter() *tableForwardIter {
+	keys := make([]string, 0, len(t.offsetMap))
+	for k := range t.offsetMap {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return &tableForwardIter{t: t, keys: keys, pos: -1}
+}
+
+func (it *tableForwardIter) seekGE(key []byte) bool {
+	it.pos = sort.Search(len(it.keys), func(i int) bool { return it.keys[i] >= string(key) }) - 1
+	return it.next()
+}
+
+func (it *tableForwardIter) next() bool {
+	it.pos++
+	return it.pos < len(it.keys)
+}
+
+// entry returns the record at the iterator's current position, shadowed by
+// this table's own range tombstones the same way table.get is: a point
+// entry covered by a higher-seq range tombstone surfaces as a tombstone
+// instead of its stale value, so the merge iterator only has to worry about
+// cross-source (strictly newer-ranked) coverage.
+func (it *tableForwardIter) entry() iterEntry {
+	k := it.keys[it.pos]
+	loc := it.t.offsetMap[k]
+	if tombSeq, covered := it.t.rangeTombstones.covers([]byte(k), ^uint64(0)); covered && tombSeq > loc.Seq {
+		return iterEntry{key: []byte(k), op: opDelete}
+	}
+	e := iterEntry{key: []byte(k), op: loc.Op}
+	if loc.Op == opPut {
+		val, err := it.t.readValue(loc)
+		if err != nil {
+			logrus.Fatalf("table: unable to read value during scan: %s", err.Error())
+		}
+		e.value = val
+	}
+	return e
+}
+
+// parseEntryAt decodes the record starting at byte offset at within a
+// decompressed block. Layout: op(1) seq(varint) keylen(varint) key
+// [vallen(varint) value].
+func parseEntryAt(raw []byte, at uint32) (op opType, seq uint64, key, value []byte, next uint32) {
+	buf := raw[at:]
+	op = opType(buf[0])
+	buf = buf[1:]
+	s, n := binary.Uvarint(buf)
+	seq = s
+	buf = buf[n:]
+	kl, n := binary.Uvarint(buf)
+	buf = buf[n:]
+	key = buf[:kl]
+	buf = buf[kl:]
+	if op == opPut {
+		vl, n := binary.Uvarint(buf)
+		buf = buf[n:]
+		value = buf[:vl]
+		buf = buf[vl:]
+	}
+	next = uint32(len(raw) - len(buf))
+	return
+}
+
+func encodeEntry(dst *bytes.Buffer, op opType, seq uint64, key, value []byte) {
+	var head [1 + binary.MaxVarintLen64*2]byte
+	n := 0
+	head[n] = byte(op)
+	n++
+	n += binary.PutUvarint(head[n:], seq)
+	n += binary.PutUvarint(head[n:], uint64(len(key)))
+	dst.Write(head[:n])
+	dst.Write(key)
+	if op == opPut {
+		var vbuf [binary.MaxVarintLen64]byte
+		vn := binary.PutUvarint(vbuf[:], uint64(len(value)))
+		dst.Write(vbuf[:vn])
+		dst.Write(value)
+	}
+}
+
+// mergeTableBuilder assembles a new table file, either by copying whole
+// compressed blocks straight out of the tables being merged (mergeTable)
+// or by encoding fresh records one at a time (hashMap.toDisk,
+// loadBalancing). Either way, finish() appends the combined index and
+// trailer that make the result a valid table file.
+type mergeTableBuilder struct {
+	buf         bytes.Buffer
+	idx         tableIndex
+	minRange    []byte
+	maxRange    []byte
+	entries     uint32
+	compression CompressionType
+}
+
+// newTableMergeBuilder starts a new table build; sizeHint is a best-effort
+// estimate of the final size so the builder's buffer doesn't have to grow
+// one reallocation at a time on the common path.
+func newTableMergeBuilder(sizeHint int, compression CompressionType) *mergeTableBuilder {
+	b := &mergeTableBuilder{compression: compression}
+	if sizeHint > 0 {
+		b.buf.Grow(sizeHint)
+	}
+	b.idx.Offsets = make(map[string]entryLoc)
+	return b
+}
+
+func (b *mergeTableBuilder) updateRange(key []byte) {
+	if b.minRange == nil || bytes.Compare(key, b.minRange) < 0 {
+		b.minRange = append([]byte(nil), key...)
+	}
+	if b.maxRange == nil || bytes.Compare(key, b.maxRange) > 0 {
+		b.maxRange = append([]byte(nil), key...)
+	}
+}
+
+// append copies the first n bytes of fp (a source table's data section)
+// verbatim into the builder's buffer; mergeHashMap below rebases that
+// table's offsetMap onto wherever those bytes landed.
+func (b *mergeTableBuilder) append(fp *os.File, n int64) {
+	if _, err := fp.Seek(0, io.SeekStart); err != nil {
+		logrus.Fatalf("compaction: unable to seek source table: %s", err.Error())
+	}
+	if _, err := io.CopyN(&b.buf, fp, n); err != nil && err != io.EOF {
+		logrus.Fatalf("compaction: unable to copy source table data: %s", err.Error())
+	}
+}
+
+// mergeHashMap folds offsets (a source table's offsetMap) into the
+// builder's combined index, adding base to every BlockOffset so it points
+// at the right place in the builder's concatenated data section. Entries
+// already present win, since mergeTable always merges the newer source
+// table first.
+func (b *mergeTableBuilder) mergeHashMap(offsets map[string]entryLoc, base uint32) {
+	for k, loc := range offsets {
+		if _, exists := b.idx.Offsets[k]; exists {
+			continue
+		}
+		loc.BlockOffset += base
+		b.idx.Offsets[k] = loc
+		b.entries++
+		b.updateRange([]byte(k))
+	}
+}
+
+// dropTombstones removes point tombstones from the merged index once
+// isBottom reports there's no older table left for them to shadow. The
+// bytes backing a dropped tombstone are left in place in the already
+// copied data section; they're just no longer reachable through the
+// index, and disappear for good the next time this table is itself
+// compacted.
+func (b *mergeTableBuilder) dropTombstones(isBottom bool) {
+	if !isBottom {
+		return
+	}
+	for k, loc := range b.idx.Offsets {
+		if loc.Op != opPut {
+			delete(b.idx.Offsets, k)
+			b.entries--
+		}
+	}
+}
+
+func (b *mergeTableBuilder) setRangeTombstones(rt *rangeTombstoneList) {
+	if rt.isEmpty() {
+		return
+	}
+	for _, t := range rt.tombstones {
+		b.idx.Ranges = append(b.idx.Ranges, rangeTombstoneWire{Start: t.start, End: t.end, Seqno: t.seqno})
+	}
+}
+
+// addRecord appends a single fresh record as its own compressed block,
+// used by hashMap.toDisk to turn a memtable into an L0 table.
+func (b *mergeTableBuilder) addRecord(op opType, key, value []byte, seq uint64) {
+	var raw bytes.Buffer
+	encodeEntry(&raw, op, seq, key, value)
+
+	blockOffset := uint32(b.buf.Len())
+	b.buf.Write(encodeBlock(b.compression, raw.Bytes()))
+	b.idx.Offsets[string(key)] = entryLoc{BlockOffset: blockOffset, WithinBlock: 0, Op: op, Seq: seq}
+	b.entries++
+	b.updateRange(key)
+}
+
+// add appends a single already-live record during loadBalancing's L1
+// split; kl/vl/hash are as returned by tableIter.next so callers don't
+// need to recompute them.
+func (b *mergeTableBuilder) add(kl, vl uint32, key, val []byte, hash uint32) {
+	b.addRecord(opPut, key[:kl], val[:vl], 0)
+}
+
+// finish appends the combined index and an 8-byte trailer (the offset the
+// index starts at) to the builder's data section and returns the complete
+// table file contents.
+func (b *mergeTableBuilder) finish() []byte {
+	metaOffset := uint32(b.buf.Len())
+	b.idx.MinRange = b.minRange
+	b.idx.MaxRange = b.maxRange
+	b.idx.Entries = b.entries
+	b.idx.Compression = b.compression
+
+	var gobBuf bytes.Buffer
+	if err := gob.NewEncoder(&gobBuf).Encode(b.idx); err != nil {
+		logrus.Fatalf("compaction: unable to encode table index: %s", err.Error())
+	}
+	b.buf.Write(gobBuf.Bytes())
+
+	var trailer [8]byte
+	binary.BigEndian.PutUint64(trailer[:], uint64(metaOffset))
+	b.buf.Write(trailer[:])
+	return b.buf.Bytes()
+}
@@ -0,0 +1,96 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import (
+	"bytes"
+	"sort"
+)
+
+// rangeTombstone marks [start, end) as deleted as of seqno. It shadows any
+// put or point tombstone for a key in that range with a lower seqno.
+type rangeTombstone struct {
+	start []byte
+	end   []byte
+	seqno uint64
+}
+
+func (rt rangeTombstone) covers(key []byte) bool {
+	return bytes.Compare(key, rt.start) >= 0 && bytes.Compare(key, rt.end) < 0
+}
+
+func (rt rangeTombstone) overlaps(start, end []byte) bool {
+	return bytes.Compare(rt.start, end) < 0 && bytes.Compare(start, rt.end) < 0
+}
+
+// rangeTombstoneList is the per-table (or per-memtable) collection of range
+// deletions, kept sorted by start key so overlap checks don't require
+// decoding every key in the table.
+type rangeTombstoneList struct {
+	tombstones []rangeTombstone
+}
+
+func newRangeTombstoneList() *rangeTombstoneList {
+	return &rangeTombstoneList{}
+}
+
+func (l *rangeTombstoneList) add(start, end []byte, seqno uint64) {
+	l.tombstones = append(l.tombstones, rangeTombstone{start: start, end: end, seqno: seqno})
+	sort.Slice(l.tombstones, func(i, j int) bool {
+		return bytes.Compare(l.tombstones[i].start, l.tombstones[j].start) < 0
+	})
+}
+
+// covers reports whether key is covered by a range tombstone with seqno at
+// or below asOf, and returns the highest such covering seqno.
+func (l *rangeTombstoneList) covers(key []byte, asOf uint64) (uint64, bool) {
+	var best uint64
+	found := false
+	for _, rt := range l.tombstones {
+		if rt.seqno <= asOf && rt.covers(key) && (!found || rt.seqno > best) {
+			best, found = rt.seqno, true
+		}
+	}
+	return best, found
+}
+
+func (l *rangeTombstoneList) overlapsRange(start, end []byte) bool {
+	for _, rt := range l.tombstones {
+		if rt.overlaps(start, end) {
+			return true
+		}
+	}
+	return false
+}
+
+func (l *rangeTombstoneList) isEmpty() bool {
+	return l == nil || len(l.tombstones) == 0
+}
+
+// merge combines two range-tombstone lists, keeping both entries since a
+// later tombstone narrower than an earlier one can still apply to part of
+// the range. Callers at the bottom level drop tombstones entirely once no
+// older overlapping table remains.
+func mergeRangeTombstoneLists(a, b *rangeTombstoneList) *rangeTombstoneList {
+	out := newRangeTombstoneList()
+	if !a.isEmpty() {
+		out.tombstones = append(out.tombstones, a.tombstones...)
+	}
+	if !b.isEmpty() {
+		out.tombstones = append(out.tombstones, b.tombstones...)
+	}
+	sort.Slice(out.tombstones, func(i, j int) bool {
+		return bytes.Compare(out.tombstones[i].start, out.tombstones[j].start) < 0
+	})
+	return out
+}
@@ -0,0 +1,212 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Sirupsen/logrus"
+)
+
+const logFileSuffix = ".log"
+
+// maxLogRecordLen bounds a single replayed key or value: a torn write can
+// corrupt the length header itself into something enormous before the CRC
+// is ever checked, and make([]byte, klen) on an untrusted klen would try to
+// allocate however much garbage that decodes to. Nothing aran ever appends
+// comes close to this, so treating a length above it as corrupt (same as a
+// CRC mismatch) costs nothing on the happy path.
+const maxLogRecordLen = 1 << 28
+
+func giveLogPath(absPath string, id uint64) string {
+	return filepath.Join(absPath, fmt.Sprintf("%06d%s", id, logFileSuffix))
+}
+
+// logFile is the write-ahead log backing the memtable with the same id:
+// every mutation applied to that memtable is appended here before New can
+// treat it as durable.
+type logFile struct {
+	id uint64
+	fp *os.File
+}
+
+func createLog(absPath string, id uint64) (*logFile, error) {
+	fp, err := os.OpenFile(giveLogPath(absPath, id), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0666)
+	if err != nil {
+		return nil, err
+	}
+	return &logFile{id: id, fp: fp}, nil
+}
+
+// logRecord layout: crc32(4) keylen(varint) vallen(varint) op(1) seq(varint)
+// key value. The crc covers op/seq/key/value so a torn write during a
+// crash is detected and recovery can stop at the first corrupt record
+// instead of the file.
+func (l *logFile) append(op opType, seq uint64, key, value []byte) error {
+	head := make([]byte, binary.MaxVarintLen64*3+1)
+	n := binary.PutUvarint(head, uint64(len(key)))
+	n += binary.PutUvarint(head[n:], uint64(len(value)))
+	head[n] = byte(op)
+	n++
+	n += binary.PutUvarint(head[n:], seq)
+	head = head[:n]
+
+	c := crc32.New(CastagnoliCrcTable)
+	c.Write(head)
+	c.Write(key)
+	c.Write(value)
+
+	var crcBuf [4]byte
+	binary.BigEndian.PutUint32(crcBuf[:], c.Sum32())
+
+	for _, b := range [][]byte{crcBuf[:], head, key, value} {
+		if _, err := l.fp.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (l *logFile) sync() error {
+	return l.fp.Sync()
+}
+
+func (l *logFile) close() error {
+	return l.fp.Close()
+}
+
+func (l *logFile) remove(absPath string) error {
+	l.fp.Close()
+	return os.Remove(giveLogPath(absPath, l.id))
+}
+
+// scanOrphanLogs returns the ids of every *.log file left behind in
+// absPath, sorted oldest first, so New can replay them in write order.
+func scanOrphanLogs(absPath string) ([]uint64, error) {
+	entries, err := os.ReadDir(absPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	var ids []uint64
+	for _, e := range entries {
+		name := e.Name()
+		if !strings.HasSuffix(name, logFileSuffix) {
+			continue
+		}
+		id, err := strconv.ParseUint(strings.TrimSuffix(name, logFileSuffix), 10, 64)
+		if err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids, nil
+}
+
+// replayLog reads every well-formed record out of the log file with the
+// given id and applies it to into, returning the highest sequence number
+// seen so the caller can resume numbering new writes after it. It stops at
+// the first short/corrupt record, since that's the tail of a log that was
+// being appended to when the process crashed.
+func replayLog(absPath string, id uint64, into *hashMap) (uint64, error) {
+	fp, err := os.Open(giveLogPath(absPath, id))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return 0, nil
+		}
+		return 0, err
+	}
+	defer fp.Close()
+
+	var maxSeq uint64
+	r := bufio.NewReader(fp)
+	for {
+		var crcBuf [4]byte
+		if _, err := io.ReadFull(r, crcBuf[:]); err != nil {
+			break
+		}
+		klen, err := binary.ReadUvarint(r)
+		if err != nil {
+			break
+		}
+		vlen, err := binary.ReadUvarint(r)
+		if err != nil {
+			break
+		}
+		if klen > maxLogRecordLen || vlen > maxLogRecordLen {
+			logrus.Warnf("wal: implausible record length in log %d (klen=%d vlen=%d), stopping replay", id, klen, vlen)
+			break
+		}
+		op, err := r.ReadByte()
+		if err != nil {
+			break
+		}
+		seq, err := binary.ReadUvarint(r)
+		if err != nil {
+			break
+		}
+		key := make([]byte, klen)
+		if _, err := io.ReadFull(r, key); err != nil {
+			break
+		}
+		value := make([]byte, vlen)
+		if _, err := io.ReadFull(r, value); err != nil {
+			break
+		}
+
+		c := crc32.New(CastagnoliCrcTable)
+		head := make([]byte, 0, binary.MaxVarintLen64*3+1)
+		head = appendUvarint(head, klen)
+		head = appendUvarint(head, vlen)
+		head = append(head, op)
+		head = appendUvarint(head, seq)
+		c.Write(head)
+		c.Write(key)
+		c.Write(value)
+		if binary.BigEndian.Uint32(crcBuf[:]) != c.Sum32() {
+			logrus.Warnf("wal: corrupt record in log %d, stopping replay", id)
+			break
+		}
+
+		switch opType(op) {
+		case opPut:
+			into.Set(key, value, seq)
+		case opDelete:
+			into.SetTombstone(key, seq)
+		case opRangeDelete:
+			into.SetRangeTombstone(key, value, seq)
+		}
+		if seq > maxSeq {
+			maxSeq = seq
+		}
+	}
+	return maxSeq, nil
+}
+
+func appendUvarint(buf []byte, v uint64) []byte {
+	var tmp [binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], v)
+	return append(buf, tmp[:n]...)
+}
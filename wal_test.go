@@ -0,0 +1,184 @@
+// Copyright 2019 sch00lb0y.
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// See the License for the specific language governing permissions and
+// limitations under the License.
+package aran
+
+import (
+	"os"
+	"testing"
+)
+
+// TestReplayLogRecoversAfterCrash simulates a crash: records are appended
+// and fsynced to a log file that's never cleanly removed (that only
+// happens after flushMem lands the memtable as an L0 table), then a fresh
+// process finds it via scanOrphanLogs and replays it the way New's
+// recoverFromLogs does on startup.
+func TestReplayLogRecoversAfterCrash(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := createLog(dir, 1)
+	if err != nil {
+		t.Fatalf("createLog: %v", err)
+	}
+	records := []struct {
+		op    opType
+		key   string
+		value string
+	}{
+		{opPut, "a", "1"},
+		{opPut, "b", "2"},
+		{opDelete, "a", ""},
+		{opPut, "c", "3"},
+	}
+	for i, r := range records {
+		if err := log.append(r.op, uint64(i+1), []byte(r.key), []byte(r.value)); err != nil {
+			t.Fatalf("append: %v", err)
+		}
+	}
+	if err := log.sync(); err != nil {
+		t.Fatalf("sync: %v", err)
+	}
+	if err := log.fp.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	ids, err := scanOrphanLogs(dir)
+	if err != nil {
+		t.Fatalf("scanOrphanLogs: %v", err)
+	}
+	if len(ids) != 1 || ids[0] != 1 {
+		t.Fatalf("scanOrphanLogs() = %v, want [1]", ids)
+	}
+
+	recovered := newHashMap(1 << 20)
+	maxSeq, err := replayLog(dir, ids[0], recovered)
+	if err != nil {
+		t.Fatalf("replayLog: %v", err)
+	}
+	if maxSeq != 4 {
+		t.Fatalf("maxSeq = %d, want 4", maxSeq)
+	}
+
+	if _, op, ok := recovered.Get([]byte("a")); !ok || op != opDelete {
+		t.Fatalf("key a: op=%v ok=%v, want opDelete/true", op, ok)
+	}
+	if val, op, ok := recovered.Get([]byte("b")); !ok || op != opPut || string(val) != "2" {
+		t.Fatalf("key b: val=%q op=%v ok=%v, want 2/opPut/true", val, op, ok)
+	}
+	if val, op, ok := recovered.Get([]byte("c")); !ok || op != opPut || string(val) != "3" {
+		t.Fatalf("key c: val=%q op=%v ok=%v, want 3/opPut/true", val, op, ok)
+	}
+}
+
+// TestReplayLogStopsAtTornWrite confirms replayLog stops cleanly at the
+// first short/corrupt record rather than erroring out the whole replay,
+// since that's the expected shape of the tail of a log that was mid-append
+// when the crash happened.
+func TestReplayLogStopsAtTornWrite(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := createLog(dir, 7)
+	if err != nil {
+		t.Fatalf("createLog: %v", err)
+	}
+	if err := log.append(opPut, 1, []byte("k1"), []byte("v1")); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := log.append(opPut, 2, []byte("k2"), []byte("v2")); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := log.fp.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	path := giveLogPath(dir, 7)
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatalf("stat: %v", err)
+	}
+	if err := os.Truncate(path, info.Size()-3); err != nil {
+		t.Fatalf("truncate: %v", err)
+	}
+
+	recovered := newHashMap(1 << 20)
+	maxSeq, err := replayLog(dir, 7, recovered)
+	if err != nil {
+		t.Fatalf("replayLog: %v", err)
+	}
+	if maxSeq != 1 {
+		t.Fatalf("maxSeq = %d, want 1 (second record is torn)", maxSeq)
+	}
+	if _, _, ok := recovered.Get([]byte("k1")); !ok {
+		t.Fatalf("k1 should have survived replay")
+	}
+	if _, _, ok := recovered.Get([]byte("k2")); ok {
+		t.Fatalf("k2 is the torn record and should not have been applied")
+	}
+}
+
+// TestReplayLogStopsAtCorruptLength corrupts a record's klen header itself
+// (rather than truncating its value payload, like
+// TestReplayLogStopsAtTornWrite does) into an implausibly large length, and
+// confirms replayLog stops instead of trying to allocate however much
+// garbage that length decodes to.
+func TestReplayLogStopsAtCorruptLength(t *testing.T) {
+	dir := t.TempDir()
+
+	log, err := createLog(dir, 9)
+	if err != nil {
+		t.Fatalf("createLog: %v", err)
+	}
+	if err := log.append(opPut, 1, []byte("k1"), []byte("v1")); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := log.append(opPut, 2, []byte("k2"), []byte("v2")); err != nil {
+		t.Fatalf("append: %v", err)
+	}
+	if err := log.fp.Close(); err != nil {
+		t.Fatalf("close: %v", err)
+	}
+
+	path := giveLogPath(dir, 9)
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("read: %v", err)
+	}
+
+	// the first record is crc(4) + klen(1, "k1" is one byte as a uvarint) +
+	// vlen(1) + op(1) + seq(1) + key(2) + value(2) = 12 bytes, so the second
+	// record's klen header starts right after it.
+	firstRecordLen := 4 + 1 + 1 + 1 + 1 + 2 + 2
+	klenOff := firstRecordLen + 4
+	raw[klenOff] = 0xff
+	raw[klenOff+1] = 0xff
+	raw[klenOff+2] = 0xff
+	raw[klenOff+3] = 0xff
+	raw[klenOff+4] = 0x7f
+	if err := os.WriteFile(path, raw, 0666); err != nil {
+		t.Fatalf("write: %v", err)
+	}
+
+	recovered := newHashMap(1 << 20)
+	maxSeq, err := replayLog(dir, 9, recovered)
+	if err != nil {
+		t.Fatalf("replayLog: %v", err)
+	}
+	if maxSeq != 1 {
+		t.Fatalf("maxSeq = %d, want 1 (second record's length header is corrupt)", maxSeq)
+	}
+	if _, _, ok := recovered.Get([]byte("k1")); !ok {
+		t.Fatalf("k1 should have survived replay")
+	}
+	if _, _, ok := recovered.Get([]byte("k2")); ok {
+		t.Fatalf("k2 has a corrupt length header and should not have been applied")
+	}
+}